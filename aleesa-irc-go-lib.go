@@ -1,10 +1,9 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
-	"regexp"
-	"slices"
 	"strings"
 	"time"
 
@@ -14,18 +13,24 @@ import (
 	irc "github.com/thoj/go-ircevent"
 )
 
-// ircClientInit горутинка для работы с протоколом irc.
-func ircClientRun() {
-	for !shutdown {
+// ircClientRun горутинка для работы с протоколом irc, работает, пока не отменён ctx.
+func ircClientRun(ctx context.Context) {
+	defer close(ircDone)
+
+	for ctx.Err() == nil {
+		// Настройки соединения без рестарта не меняются, но конфиг при каждом переподключении берём свежий
+		config := currentConfig()
+
 		// Иницализируем irc-клиента.
-		// TODO: make use of capabilities: https://defs.ircdocs.horse/defs/clientcaps .
-		// TODO: make use of tags caps https://defs.ircdocs.horse/defs/tags .
 		serverString := fmt.Sprintf("%s:%d", config.Irc.Server, config.Irc.Port)
 		log.Debugf("Preparing to connect to %s", serverString)
 		log.Debugf("Using nick %s and username %s", config.Irc.Nick, config.Irc.User)
 		ircClient = irc.IRC(config.Irc.Nick, config.Irc.User)
 		ircClient.RealName = config.Irc.User
-		ircClient.Version = "Aleesa Bot v4.something"
+		ircClient.QuitMessage = config.Irc.QuitMessage
+		// Пароль сервера, если задан, go-ircevent отправит командой PASS
+		ircClient.Password = config.Irc.ServerPassword
+		ircClient.Version = config.Irc.Ctcp.Version
 
 		if config.Irc.Ssl {
 			log.Debug("Force use ssl for connection")
@@ -49,9 +54,24 @@ func ircClientRun() {
 			ircClient.UseSASL = true
 		}
 
+		// Ответы на CTCP-запросы, см. irc-ctcp.go.
+		ctcpSetup(ircClient)
+
 		// Навесим коллбэков на некоторые ответы сервера на наши запросы.
 
-		// 001 RPL_WELCOME уже есть в github.com/thoj/go-ircevent/irc_callback.go.
+		// 001 RPL_WELCOME уже есть в github.com/thoj/go-ircevent/irc_callback.go, мы лишь начинаем согласование
+		// capabilities, как только зарегистрировались на сервере.
+		ircClient.AddCallback("001", func(e *irc.Event) {
+			// Сервер мог смениться при переподключении, поэтому всё, что он нам раньше анонсировал, забываем.
+			isupport.Reset()
+			// Заодно забываем и состояние каналов, при join-е мы его получим заново.
+			chanState.Reset()
+			identities.Reset()
+
+			capNegotiate(e.Connection)
+		})
+
+		ircClient.AddCallback("CAP", capCallback)
 
 		// Сделаем уже что-то полезное! Motd нам уже прислали и теперь можно авторизоваться и джойниться
 		ircClient.AddCallback("004", func(e *irc.Event) {
@@ -82,85 +102,113 @@ func ircClientRun() {
 			e.Connection.Unlock()
 		})
 
-		ircClient.AddCallback("005", func(e *irc.Event) {
-			// TODO: Make use of it. https://defs.ircdocs.horse/defs/isupport
-		})
+		// 005 RPL_ISUPPORT, см. irc-isupport.go.
+		ircClient.AddCallback("005", isupportCallback)
 
 		ircClient.AddCallback("319", func(e *irc.Event) {
 			/* Это одна из строк с данными, прилетающая в ответ на запрос whois на определённого юзера
 			 * Из этой строки нас интересует, на каких каналах пользователь op (то есть с префиксом @) или имеет voice
-			 * (то есть с префиксом +) чтобы внести его в свою базу mode-ов.
+			 * (то есть с префиксом +), а также прочие префиксы из PREFIX, чтобы внести его в свою базу mode-ов.
 			 */
-			channelsWithModes := strings.Split(e.Arguments[2], " ")
+			channelsWithModes := strings.Fields(e.Arguments[2])
 			dstNick := e.Arguments[1]
 
 			for _, channelWithMode := range channelsWithModes {
-				for _, mychannel := range config.Irc.Channels {
-					tmp := regexp.MustCompile("#").Split(channelWithMode, 2)
-					channel := tmp[1]
-					modes := tmp[0]
-
-					if channel == mychannel {
-						// Для каждого канала формат строго 1 из 4-х:  #channel | @#channel | +#channel | @+#channel
-						switch modes {
-						case "@+":
-							userModeUpdateUser(channel, dstNick, "+o")
-							userModeUpdateUser(channel, dstNick, "+v")
-						case "@":
-							userModeUpdateUser(channel, dstNick, "+o")
-						case "+":
-							userModeUpdateUser(channel, dstNick, "+v")
-						default:
-							userModeUpdateUser(channel, dstNick, "-o")
-							userModeUpdateUser(channel, dstNick, "-v")
-						}
-
-						break
-					}
-				}
+				// Формат: #channel | @#channel | @+#channel | ~&channel и т.п., в зависимости от PREFIX и CHANTYPES.
+				// Каналы, на которых нас нет, трекер состояния просто проигнорирует.
+				channel, modes := isupport.StripPrefixes(channelWithMode)
+				chanState.SetPrefixes(channel, dstNick, modes)
+			}
+		})
+
+		// 311 RPL_WHOISUSER, 330 RPL_WHOISACCOUNT и 318 RPL_ENDOFWHOIS - ответы на WHOIS, которым мы опознаём
+		// отправителей команд, см. irc-identity.go.
+		ircClient.AddCallback("311", func(e *irc.Event) {
+			// Формат: 311 <me> <nick> <user> <host> * :<realname>
+			if len(e.Arguments) >= 4 {
+				identities.WhoisUser(e.Arguments[1], e.Arguments[2], e.Arguments[3])
+			}
+		})
+
+		ircClient.AddCallback("330", func(e *irc.Event) {
+			// Формат: 330 <me> <nick> <account> :is logged in as
+			if len(e.Arguments) >= 3 {
+				identities.WhoisAccount(e.Arguments[1], e.Arguments[2])
+			}
+		})
+
+		ircClient.AddCallback("318", func(e *irc.Event) {
+			// Формат: 318 <me> <nick> :End of /WHOIS list
+			if len(e.Arguments) >= 2 {
+				identities.WhoisEnd(e.Arguments[1], time.Now())
+			}
+		})
+
+		// 352 RPL_WHOREPLY, ответ на WHO #channel, который мы отправляем после получения списка участников канала.
+		ircClient.AddCallback("352", func(e *irc.Event) {
+			// Формат: 352 <me> <channel> <user> <host> <server> <nick> <flags> :<hopcount> <realname>
+			if len(e.Arguments) < 7 {
+				return
+			}
+
+			chanStateWhoReply(e.Arguments[1], e.Arguments[5], e.Arguments[2], e.Arguments[3], e.Arguments[6], "")
+		})
+
+		// 354 RPL_WHOSPCRPL, ответ на WHOX-запрос, в отличие от WHO в нём есть services account.
+		ircClient.AddCallback("354", func(e *irc.Event) {
+			// Формат согласно нашему запросу %tcuhnfa:
+			// 354 <me> <token> <channel> <user> <host> <nick> <flags> <account>
+			if len(e.Arguments) < 8 || e.Arguments[1] != whoxToken {
+				return
+			}
+
+			account := e.Arguments[7]
+
+			// 0 означает, что пользователь не залогинен в services.
+			if account == "0" {
+				account = ""
 			}
+
+			chanStateWhoReply(e.Arguments[2], e.Arguments[5], e.Arguments[3], e.Arguments[4], e.Arguments[6], account)
+			chanState.SetAccount(e.Arguments[5], account)
 		})
 
 		// 433 ERR_NICKNAMEINUSE уже есть в github.com/thoj/go-ircevent/irc_callback.go.
 
 		ircClient.AddCallback("353", func(e *irc.Event) {
 			// Это одна из строк данных, прилетающая в ответ на запрос names, на канале
-			e.Connection.Lock()
 			namesString := e.Arguments[3]
 			channel := e.Arguments[2]
 
-			for _, mychannel := range config.Irc.Channels {
-				if channel == mychannel {
-					for _, name := range strings.Split(namesString, " ") {
-						mode := name[:1]
-
-						var nick string
-
-						if mode == "@" || mode == "+" {
-							nick = name[1:]
-						} else {
-							nick = name
-						}
-
-						switch mode {
-						case "@":
-							userModeUpdateUser(channel, nick, "+o")
-						case "+":
-							userModeUpdateUser(channel, nick, "+v")
-						default:
-							userModeUpdateUser(channel, nick, "-o")
-							userModeUpdateUser(channel, nick, "-v")
-						}
-					}
+			for _, name := range strings.Fields(namesString) {
+				// С multi-prefix префиксов у ника может быть несколько, например @+nick.
+				nick, modes := isupport.StripPrefixes(name)
+				// А с userhost-in-names вместо ника может прилететь nick!user@host.
+				nick, userHost, _ := strings.Cut(nick, "!")
+				userName, host, _ := strings.Cut(userHost, "@")
 
-					break
-				}
+				chanState.SetPrefixes(channel, nick, modes)
+				chanState.UpdateUser(nick, userName, host)
+			}
+		})
+
+		// 366 RPL_ENDOFNAMES, список участников канала получен целиком.
+		ircClient.AddCallback("366", func(e *irc.Event) {
+			channel := e.Arguments[1]
+
+			if !chanState.IsSynced(channel) {
+				chanState.SetSynced(channel)
+				// Из NAMES мы знаем только ники и MODE-ы, остальное (host, account, away) узнаем через WHO.
+				chanStateWho(channel)
+				// А MODE-ы самого канала узнаем из 324 RPL_CHANNELMODEIS.
+				ircClient.Mode(channel)
 			}
-			e.Connection.Unlock()
 		})
 
 		// Если сервер не может прочитать MOTD, то он может вернуть 422 ERR_NOMOTD, тоде самое навесим и туда тоже.
 		ircClient.AddCallback("376", func(e *irc.Event) {
+			config := currentConfig()
+
 			// TODO: make use of modes https://defs.ircdocs.horse/defs/usermodes
 			// Если у нас есть доступный +B возьмём его себе, мы же бот.
 			announced, _ := availableUserModes.Get("announced")
@@ -183,15 +231,19 @@ func ircClientRun() {
 				log.Info("Identifying via NickServ")
 
 				message := fmt.Sprintf("identify %s %s", config.Irc.Nick, config.Irc.Password)
-				imChan <- iMsg{ChatID: "NickServ", Text: message}
+				sender.EnqueuePriority(iMsg{ChatID: "NickServ", Text: message})
 			}
 			// TODO: wait until +R flag been set? could be implemented with waiting for channel message.
 
 			log.Debug("Trying to join to preconfigured channels")
 
 			for _, channel := range config.Irc.Channels {
-				log.Infof("Joining to %s channel", channel)
-				ircClient.Join(channel)
+				if !channel.Autojoin {
+					continue
+				}
+
+				log.Infof("Joining to %s channel", channel.Name)
+				ircJoin(channel.Name)
 			}
 			// TODO: wait for join or join error.
 		})
@@ -233,6 +285,8 @@ func ircClientRun() {
 
 		// Аналогичный коллбэк висит на 376 RPL_ENDOFMOTD.
 		ircClient.AddCallback("422", func(e *irc.Event) {
+			config := currentConfig()
+
 			// TODO: make use of modes https://defs.ircdocs.horse/defs/usermodes
 			// Если у нас есть доступный +B возьмём его себе, мы же бот.
 			botFlag, ok := availableUserModes.Get("B")
@@ -252,15 +306,19 @@ func ircClientRun() {
 				log.Info("Identifying via NickServ")
 
 				message := fmt.Sprintf("identify %s %s", config.Irc.Nick, config.Irc.Password)
-				imChan <- iMsg{ChatID: "NickServ", Text: message}
+				sender.EnqueuePriority(iMsg{ChatID: "NickServ", Text: message})
 			}
 			// TODO: wait until +R flag been set? could be implemented with waiting for channel message.
 
 			log.Debug("Trying to join to preconfigured channels")
 
 			for _, channel := range config.Irc.Channels {
-				log.Infof("Joining to %s channel", channel)
-				ircClient.Join(channel)
+				if !channel.Autojoin {
+					continue
+				}
+
+				log.Infof("Joining to %s channel", channel.Name)
+				ircJoin(channel.Name)
 			}
 		})
 
@@ -273,6 +331,8 @@ func ircClientRun() {
 		})
 
 		ircClient.AddCallback("433", func(e *irc.Event) {
+			config := currentConfig()
+
 			log.Errorf("433 ERR_NICKNAMEINUSE, %s", e.Raw)
 
 			nickIsUsed = true
@@ -345,8 +405,8 @@ func ircClientRun() {
 			<-time.NewTimer(30 * time.Second).C
 
 			// Проверяем, а должны ли мы быть заджоенныеми к указанному, каналу, а то вдруг нет?
-			if slices.Contains(config.Irc.Channels, channel) {
-				ircClient.Join(channel)
+			if channelConfigured(channel) {
+				ircJoin(channel)
 			}
 		})
 
@@ -362,8 +422,8 @@ func ircClientRun() {
 			<-time.NewTimer(30 * time.Second).C
 
 			// Проверяем, а должны ли мы быть заджоенными к указанному, каналу, а то вдруг нет?
-			if slices.Contains(config.Irc.Channels, channel) {
-				ircClient.Join(channel)
+			if channelConfigured(channel) {
+				ircJoin(channel)
 			}
 		})
 
@@ -379,8 +439,8 @@ func ircClientRun() {
 			// TODO: вынести в настройки?
 
 			// Проверяем, а должны ли мы быть заджоенныеми к указанному, каналу, а то вдруг нет?
-			if slices.Contains(config.Irc.Channels, channel) {
-				ircClient.Join(channel)
+			if channelConfigured(channel) {
+				ircJoin(channel)
 			}
 		})
 
@@ -430,26 +490,28 @@ func ircClientRun() {
 			srcFullNick := e.Source
 			channel := e.Arguments[0]
 
-			if e.Arguments[1] == ircClient.GetNick() {
+			if isMe(dstNick) {
 				// Нас кикнули с канала, и мы теряем информацию о MODE-ах пользователей
-				userMode.Delete(channel)
+				chanState.SelfLeave(channel)
 				// TODO: reason?
 				log.Warnf("%s kicks us from %s", srcFullNick, channel)
 				<-time.NewTimer(10 * time.Second).C
 
-				ircClient.Join(channel)
+				ircJoin(channel)
 			} else {
 				// Кого-то другого кикнули с канала
 				log.Infof("On %s %s kicks %s from channel", channel, srcFullNick, dstNick)
-				userModeDeleteUser(channel, dstNick)
+				chanState.Leave(channel, dstNick)
 			}
 		})
 
 		ircClient.AddCallback("NICK", func(e *irc.Event) {
+			config := currentConfig()
+
 			srcNick := e.Nick
 			dstNick := e.Arguments[0]
 
-			if e.Nick == config.Irc.Nick {
+			if isupport.Equal(srcNick, config.Irc.Nick) {
 				nickIsUsed = false
 
 				if config.Irc.Password != "" {
@@ -458,16 +520,16 @@ func ircClientRun() {
 					log.Warn("I regain my nick, trying to identify myself via NickServ")
 
 					message := fmt.Sprintf("identify %s %s", config.Irc.Nick, config.Irc.Password)
-					imChan <- iMsg{ChatID: "NickServ", Text: message}
+					sender.EnqueuePriority(iMsg{ChatID: "NickServ", Text: message})
 				}
 			} else {
 				log.Infof("%s renames themself to %s", srcNick, dstNick)
 			}
 
-			// Неважно чей ник сменился, надо забыть, что было и снова узнать mode-ы сменишего nick джентельмена.
-			// TODO: реализовать userModeRenameUser()
-			userModePurgeUser(srcNick)
-			ircClient.Whois(dstNick)
+			// Неважно чей ник сменился, переносим все сведения о нём под новый ник.
+			chanState.Rename(srcNick, dstNick)
+			identities.Forget(srcNick)
+			identities.Forget(dstNick)
 		})
 
 		ircClient.AddCallback("JOIN", func(e *irc.Event) {
@@ -475,14 +537,29 @@ func ircClientRun() {
 			fullNick := e.Source
 			channel := e.Arguments[0]
 
-			if nick == ircClient.GetNick() {
+			if isMe(nick) {
 				// Команда names отправляется автоматом.
 				log.Infof("I joined to %s", channel)
+				chanState.SelfJoin(channel)
+				// Заодно узнаем, как нас видит сервер, это нужно, чтобы правильно резать длинные сообщения.
+				chanState.Join(channel, nick, e.User, e.Host, "")
 			} else {
 				log.Infof("%s joined to %s", fullNick, channel)
-				// Технически, тут не надо спрашивать whois на пользователя, но мы спрашиваем, чтобы уточнить mode,
-				// вдруг сервер проставляет mode заранее (хотя не должен).
-				ircClient.Whois(nick)
+
+				// С extended-join сервер присылает account пользователя прямо в JOIN, "*" - если он не залогинен.
+				account := tagAccount(e.Tags)
+
+				if capIsAcked("extended-join") && len(e.Arguments) >= 2 && e.Arguments[1] != "*" {
+					account = e.Arguments[1]
+				}
+
+				// MODE-ы при заходе сервер проставлять не должен, а если проставит, то пришлёт отдельный MODE.
+				chanState.Join(channel, nick, e.User, e.Host, account)
+
+				// С extended-join "*" - это тоже знание: пользователь не залогинен
+				if capIsAcked("extended-join") && len(e.Arguments) >= 2 {
+					chanState.SetAccount(nick, account)
+				}
 			}
 		})
 
@@ -491,12 +568,12 @@ func ircClientRun() {
 			fullNick := e.Source
 			channel := e.Arguments[0]
 
-			if nick == ircClient.GetNick() {
+			if isMe(nick) {
 				log.Infof("I parted from %s", channel)
-				userMode.Delete(channel)
+				chanState.SelfLeave(channel)
 			} else {
 				log.Infof("%s parted from %s", fullNick, channel)
-				userModeDeleteUser(channel, nick)
+				chanState.Leave(channel, nick)
 			}
 		})
 
@@ -505,38 +582,87 @@ func ircClientRun() {
 			fullNick := e.Source
 
 			// TODO: Quit message? But who really cares?
-			if nick == ircClient.GetNick() {
+			if isMe(nick) {
 				log.Info("I quit")
 			} else {
 				log.Infof("%s has quit", fullNick)
 				// Товарищ свалил из irc, забудем про его mode-ы
-				userModePurgeUser(nick)
+				chanState.Quit(nick)
+				identities.Forget(nick)
 			}
 		})
 
 		ircClient.AddCallback("MODE", func(e *irc.Event) {
-			mode := e.Arguments[1]
-			channel := e.Arguments[0]
-			fullSrcNick := e.Source
-			srcNick := e.Nick
+			if len(e.Arguments) < 2 {
+				return
+			}
 
-			var dstNick string
+			target := e.Arguments[0]
+			modes := e.Arguments[1]
+			params := e.Arguments[2:]
+
+			if !isupport.IsChannel(target) {
+				// Это user MODE, а менять его можем только мы сами, либо сервер при заходе.
+				for _, change := range parseUserModes(modes) {
+					if change.Set {
+						log.Infof("%s now has user mode +%c", target, change.Mode)
+					} else {
+						log.Infof("%s now has user mode -%c", target, change.Mode)
+					}
+				}
 
-			if len(e.Arguments) >= 3 { // кого-то по-MODE-или на канале
-				dstNick = e.Arguments[2]
+				return
+			}
 
-				if srcNick == ircClient.GetNick() {
-					log.Infof("I set user %s mode %s on %s", dstNick, mode, channel)
-				} else {
-					log.Infof("%s set user %s mode %s on %s", fullSrcNick, dstNick, mode, channel)
-				}
-			} else { // Установка mode-а при заходе на сервер
-				dstNick = e.Arguments[0]
+			if isMe(e.Nick) {
+				log.Infof("I set mode %s %s on %s", modes, strings.Join(params, " "), target)
+			} else {
+				log.Infof("%s set mode %s %s on %s", e.Source, modes, strings.Join(params, " "), target)
+			}
 
-				log.Infof("Server set my mode to %s", mode)
+			chanState.ApplyModes(target, parseChanModes(modes, params))
+		})
+
+		// 324 RPL_CHANNELMODEIS, ответ на MODE #channel, который мы отправляем после получения списка участников.
+		ircClient.AddCallback("324", func(e *irc.Event) {
+			// Формат: 324 <me> <channel> <modes> [<params> ...]
+			if len(e.Arguments) < 3 {
+				return
+			}
+
+			chanState.ApplyModes(e.Arguments[1], parseChanModes(e.Arguments[2], e.Arguments[3:]))
+		})
+
+		// С away-notify сервер сообщает, когда участники наших каналов отходят и возвращаются.
+		ircClient.AddCallback("AWAY", func(e *irc.Event) {
+			away := len(e.Arguments) > 0 && e.Arguments[0] != ""
+			chanState.SetAway(e.Nick, away)
+		})
+
+		// С chghost сервер сообщает о смене user или host вместо QUIT и JOIN.
+		ircClient.AddCallback("CHGHOST", func(e *irc.Event) {
+			if len(e.Arguments) < 2 {
+				return
+			}
+
+			log.Debugf("%s changed user and host to %s@%s", e.Source, e.Arguments[0], e.Arguments[1])
+			chanState.UpdateUser(e.Nick, e.Arguments[0], e.Arguments[1])
+		})
+
+		// С account-notify сервер сообщает, когда пользователь логинится в services или разлогинивается ("*").
+		ircClient.AddCallback("ACCOUNT", func(e *irc.Event) {
+			if len(e.Arguments) < 1 {
+				return
+			}
+
+			account := e.Arguments[0]
+
+			if account == "*" {
+				account = ""
 			}
 
-			userModeUpdateUser(channel, dstNick, mode)
+			chanState.SetAccount(e.Nick, account)
+			identities.Forget(e.Nick)
 		})
 
 		ircClient.AddCallback("TOPIC", func(e *irc.Event) {
@@ -545,7 +671,7 @@ func ircClientRun() {
 			topic := e.Arguments[1]
 			channel := e.Arguments[0]
 
-			if nick == ircClient.GetNick() {
+			if isMe(nick) {
 				log.Infof("I set topic on %s to %s", channel, topic)
 			} else {
 				log.Infof("%s set topic on %s to %s", fullNick, channel, topic)
@@ -557,21 +683,28 @@ func ircClientRun() {
 			dstNick := e.Arguments[0]
 			channel := e.Arguments[1]
 
-			if srcNick == ircClient.GetNick() {
+			if isMe(srcNick) {
 				log.Infof("I invite %s to %s", dstNick, channel)
 			} else {
 				log.Infof("%s invites me to %s", srcNick, channel)
 			}
 		})
 
-		// TODO: Implement standard action like slap, f.ex.
-
 		// Здесь у нас парсер сообщений из IRC
 		ircClient.AddCallback("PRIVMSG", func(e *irc.Event) {
 			log.Debugf("Incoming PRIVMSG: %s", e.Raw)
-			ircMsgParser(e.Arguments[0], e.Nick, e.User, e.Source, e.Arguments[1])
+			ircMsgParser(e.Arguments[0], e.Nick, e.User, e.Source, e.Arguments[1], e.Tags, msgKindPrivmsg)
 		})
 
+		// /me, go-ircevent уже снял с текста CTCP-обёртку.
+		ircClient.AddCallback("CTCP_ACTION", func(e *irc.Event) {
+			log.Debugf("Incoming ACTION: %s", e.Raw)
+			ircMsgParser(e.Arguments[0], e.Nick, e.User, e.Source, e.Message(), e.Tags, msgKindAction)
+		})
+
+		// NOTICE-ы, см. irc-notice.go.
+		ircClient.AddCallback("NOTICE", noticeCallback)
+
 		ircClient.AddCallback("*", func(e *irc.Event) {
 			log.Debugf("Incoming EVENT (Raw): %s", e.Raw)
 		})
@@ -580,111 +713,17 @@ func ircClientRun() {
 
 		if err := ircClient.Connect(serverString); err != nil {
 			log.Errorf("Unable to prepare irc connection: %s", err)
-			<-time.NewTimer(3 * time.Second).C // Sleep for 3 seconds.
-
-			continue
-		}
-
-		ircClient.Loop()
-	}
-}
-
-// ircSend отправляет сообщение в irc. Якобы с применением ratelimit-ов, но на практике длинные сообщения разделяются
-// на более короткие и тут ratelimit не срабатывает. Если не повезёт, то сервер может за такое дело и кикнуть.
-func ircSend() {
-	for {
-		m := <-imChan
-
-		switch config.Irc.RateLimit.Type {
-		case "simple_delay":
-			log.Debugf("Sending to chat %s message: %s", m.ChatID, m.Text)
-
-			if m.Text[0:4] == "/me " {
-				ircClient.Action(m.ChatID, m.Text)
-			} else {
-				ircClient.Privmsg(m.ChatID, m.Text)
-			}
-
-			sleepDelay := time.Duration(config.Irc.RateLimit.SimpleDelay) * time.Millisecond
-			log.Debugf("Due to delay type simple_delay waiting for %d milliseconds", int(sleepDelay))
-			<-time.NewTimer(sleepDelay).C
-		case "token_bucket":
-			var currentTimeMs = time.Now().UnixMilli()
 
-			var expirationTimeMs = config.Irc.RateLimit.TokenBucket.ExpirationTime * 1000
-
-			if len(msgBucket.Timestamps) > 0 {
-				var newBucket bucket
-
-				for _, timestampMs := range msgBucket.Timestamps {
-					if currentTimeMs-timestampMs < expirationTimeMs {
-						newBucket.Timestamps = append(newBucket.Timestamps, timestampMs)
-					}
-				}
-
-				bucketFill := len(newBucket.Timestamps)
-				log.Debugf("Message bucket filled with %d/%d messages", bucketFill, config.Irc.RateLimit.TokenBucket.Size)
-
-				newBucket.Timestamps = append(newBucket.Timestamps, currentTimeMs)
-
-				if bucketFill >= config.Irc.RateLimit.TokenBucket.Size {
-					newBucket.IsFull = true
-				}
-
-				msgBucket = newBucket
-			} else {
-				// Проставим время отправки сообщения
-				log.Debug("Message bucket is empty")
-
-				msgBucket.Timestamps = append(msgBucket.Timestamps, currentTimeMs)
+			// Sleep for 3 seconds.
+			select {
+			case <-ctx.Done():
+			case <-time.After(3 * time.Second):
 			}
 
-			if msgBucket.IsFull {
-				log.Debug("Message bucket overflowed, hitting ratelimit")
-
-				sleepPeriod := expirationTimeMs - (currentTimeMs - msgBucket.Timestamps[len(msgBucket.Timestamps)-1])
-
-				if config.Irc.RateLimit.TokenBucket.Limit > 0 {
-					sleepPeriod /= int64(config.Irc.RateLimit.TokenBucket.Limit)
-				}
-
-				log.Debugf("Sleeping for %d milliseconds", sleepPeriod)
-				<-time.NewTimer(time.Duration(sleepPeriod) * time.Millisecond).C
-
-				currentTimeMs = time.Now().UnixMilli()
-				// Обновим время отправки сообщения
-				msgBucket.Timestamps[len(msgBucket.Timestamps)-1] = currentTimeMs
-			}
-
-			log.Debugf("Sending to chat %s message: %s", m.ChatID, m.Text)
-
-			if len(m.Text) > 4 && m.Text[0:4] == "/me " {
-				ircClient.Action(m.ChatID, m.Text[4:])
-			} else {
-				ircClient.Privmsg(m.ChatID, m.Text)
-			}
-		default:
-			log.Debugf("Sending to chat %s message: %s", m.ChatID, m.Text)
-
-			if len(m.Text) > 4 && m.Text[0:4] == "/me " {
-				ircClient.Action(m.ChatID, m.Text[4:])
-			} else {
-				ircClient.Privmsg(m.ChatID, m.Text)
-			}
+			continue
 		}
-	}
-}
-
-func ircSendUnrestricted() {
-	for {
-		m := <-imChanUnrestricted
-		log.Debugf("Skipping ratelimit and sending to chat %s message: %s", m.ChatID, m.Text)
 
-		if len(m.Text) > 4 && m.Text[0:4] == "/me " {
-			ircClient.Action(m.ChatID, m.Text[4:])
-		} else {
-			ircClient.Privmsg(m.ChatID, m.Text)
-		}
+		ircClient.Loop()
 	}
 }
 
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* Команды, которые объявляют сами сервисы бота, чтобы для новой команды не приходилось пересобирать aleesa-irc-go.
+ * Каждый сервис пишет в redis-овый хэш redis.registry.key поле со своим именем и json-ом вида
+ *
+ *   {"commands": [{"name": "w", "aliases": ["погода"], "args": "text", "usage": "<город>", "help": "погода в городе"}]}
+ *
+ * Описание команды такое же, как в разделе commands конфига, см. command-registry.go. Хэш перечитывается раз в
+ * redis.registry.refresh секунд. Объявленные команды добавляются к командам из конфига или встроенным, а при совпадении
+ * имени заменяют их. Если redis-ка недоступна, то остаются команды, прочитанные в прошлый раз. Сервисы разбираются в
+ * порядке их имён, команду, имя или синоним которой уже занят другим сервисом, мы выкидываем с предупреждением в логе.
+ */
+
+// Как часто перечитываем объявления команд, если в конфиге это не задано, в секундах.
+const defaultRegistryRefresh = 60
+
+// commandAnnouncement - это объявление команд одного сервиса.
+type commandAnnouncement struct {
+	Commands []commandSpec `json:"commands"`
+}
+
+// commandDiscovery перечитывает объявления команд, пока не отменён ctx.
+func commandDiscovery(ctx context.Context) {
+	var previous map[string]string
+
+	for {
+		previous = discoverCommands(ctx, previous)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(currentConfig().Redis.Registry.Refresh) * time.Second):
+		}
+	}
+}
+
+// discoverCommands читает объявления команд и, если они изменились с прошлого раза (previous), обновляет реестр
+// команд. Возвращает прочитанные объявления.
+func discoverCommands(ctx context.Context, previous map[string]string) map[string]string {
+	config := currentConfig()
+
+	// Ключ могли убрать из конфига на лету
+	if config.Redis.Registry.Key == "" {
+		botCommands.Discover(nil)
+
+		return nil
+	}
+
+	announcements, err := bus.Commands(ctx)
+
+	if err != nil {
+		log.Warnf("%s, keeping previously discovered commands", err)
+
+		return previous
+	}
+
+	if previous != nil && maps.Equal(announcements, previous) {
+		return previous
+	}
+
+	specs := parseAnnouncements(announcements)
+	botCommands.Discover(specs)
+
+	if len(specs) == 0 {
+		log.Infof("No commands announced in %s, using only commands from config", config.Redis.Registry.Key)
+	} else {
+		log.Infof("Discovered %d commands announced by %d services", len(specs), len(announcements))
+	}
+
+	return announcements
+}
+
+// parseAnnouncements разбирает объявления команд от сервисов, выкидывая неправильные и повторяющиеся команды.
+func parseAnnouncements(announcements map[string]string) []commandSpec {
+	var specs []commandSpec
+
+	// Имя или синоним -> сервис, который их объявил
+	seen := make(map[string]string)
+
+	for _, service := range slices.Sorted(maps.Keys(announcements)) {
+		var announcement commandAnnouncement
+
+		if err := json.Unmarshal([]byte(announcements[service]), &announcement); err != nil {
+			log.Warnf("Unable to parse commands announced by %s: %s", service, schemaError(err))
+
+			continue
+		}
+
+		for _, spec := range announcement.Commands {
+			if problems := commandProblems(&spec, service, seen); len(problems) > 0 {
+				log.Warnf("Ignoring command %s announced by %s: %s", spec.Name, service, strings.Join(problems, "; "))
+
+				continue
+			}
+
+			specs = append(specs, spec)
+		}
+	}
+
+	return specs
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
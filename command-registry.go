@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+/* Реестр команд бота, которые пересылаются в router. Список команд задаётся в конфиге (commands), а если он там не
+ * задан, то используется встроенный defaultCommands. Сервисы бота могут объявить и свои команды, они дополняют этот
+ * список, см. command-discovery.go. У каждой команды есть имя, синонимы, вид аргумента и описание, из которых
+ * собирается ответ на !help. Команду ищем по имени в мапке, а проверяем по виду аргумента:
+ *   - none - после команды ничего нет;
+ *   - text - после команды может быть что угодно, например, город для погоды;
+ *   - nick - после команды может быть ник участника канала, тогда и отвечать надо ему, как в случае с выпивкой.
+ *
+ * Команды отключаемых плагинов (toggle) работают только на канале и только если плагин на нём включен, см.
+ * plugin-toggles.go.
+ */
+
+// Виды аргументов команд.
+const (
+	cmdArgsNone = "none"
+	cmdArgsText = "text"
+	cmdArgsNick = "nick"
+)
+
+// Команды, которые бот обрабатывает сам, в реестре их быть не может.
+var reservedCommands = []string{"help", "помощь", "admin"}
+
+// Встроенный список команд, используется, если в конфиге команды не заданы.
+var defaultCommands = []commandSpec{
+	{Name: "anek", Aliases: []string{"анек", "анекдот"}, Help: "рандомный анекдот с anekdot.ru"},
+	{Name: "buni", Help: "комикс-стрип hapi buni"},
+	{Name: "rabbit", Aliases: []string{"bunny", "кролик"}, Help: "кролик"},
+	{Name: "cat", Aliases: []string{"кис"}, Help: "кошечка"},
+	{Name: "coin", Aliases: []string{"монетка"}, Help: "подбросить монетку"},
+	{Name: "dice", Aliases: []string{"roll", "кости"}, Help: "бросить кости"},
+	{Name: "dig", Aliases: []string{"копать"}, Help: "заняться археологией"},
+	{Name: "drink", Aliases: []string{"праздник"}, Help: "какой сегодня праздник?"},
+	{Name: "fish", Aliases: []string{"fishing", "рыба", "рыбка", "рыбалка"}, Help: "порыбачить"},
+	{Name: "f", Aliases: []string{"ф", "fortune", "фортунка"}, Help: "рандомная фраза из сборника цитат fortune_mod"},
+	{Name: "fox", Aliases: []string{"лис"}, Help: "лисичка"},
+	{Name: "friday", Aliases: []string{"пятница"}, Help: "а не пятница ли сегодня?"},
+	{Name: "frog", Aliases: []string{"лягушка"}, Help: "лягушка"},
+	{Name: "horse", Aliases: []string{"лошадь", "лошадка"}, Help: "лошадка"},
+	{Name: "karma", Aliases: []string{"карма"}, Args: cmdArgsText, Usage: "фраза", Help: "посмотреть карму фразы"},
+	{Name: "lat", Aliases: []string{"лат"}, Help: "сгенерировать фразу из крылатого латинского выражения"},
+	{Name: "monkeyuser", Help: "комикс-стрип MonkeyUser"},
+	{Name: "owl", Aliases: []string{"сова", "сыч"}, Help: "сова"},
+	{Name: "ping", Aliases: []string{"пинг", "пинх", "pong", "понг", "понх"}, Help: "попинговать бота"},
+	{Name: "proverb", Aliases: []string{"пословица", "пословиться"}, Help: "рандомная русская пословица"},
+	{Name: "snail", Aliases: []string{"улитка"}, Help: "улитка"},
+	{Name: "ver", Aliases: []string{"version", "версия"}, Help: "написать что-то про версию ПО"},
+	{
+		Name:    "w",
+		Aliases: []string{"п", "weather", "погода", "погодка", "погадка"},
+		Args:    cmdArgsText,
+		Usage:   "<город>",
+		Help:    "погода в городе",
+	},
+	{Name: "xkcd", Help: "комикс-стрип с xkcb.ru"},
+	{Name: "хэлп", Aliases: []string{"halp"}},
+	{Name: "kde", Aliases: []string{"кде"}},
+	// Бармен наливает тому, кто заказал, или тому, кому заказали
+	{Name: "rum", Aliases: []string{"ром"}, Args: cmdArgsNick, Usage: "[ник]", Help: "налить рома"},
+	{Name: "vodka", Aliases: []string{"водка"}, Args: cmdArgsNick, Usage: "[ник]", Help: "налить водки"},
+	{Name: "beer", Aliases: []string{"пиво"}, Args: cmdArgsNick, Usage: "[ник]", Help: "налить пива"},
+	{Name: "tequila", Aliases: []string{"текила"}, Args: cmdArgsNick, Usage: "[ник]", Help: "налить текилы"},
+	{Name: "whisky", Aliases: []string{"виски"}, Args: cmdArgsNick, Usage: "[ник]", Help: "налить виски"},
+	{Name: "absinthe", Aliases: []string{"абсент"}, Args: cmdArgsNick, Usage: "[ник]", Help: "налить абсента"},
+	{
+		Name:    "tits",
+		Aliases: []string{"boobs", "tities", "boobies", "сиси", "сисечки"},
+		Args:    cmdArgsText,
+		Toggle:  "oboobs",
+		Help:    "сисечки",
+	},
+	{
+		Name:    "butt",
+		Aliases: []string{"booty", "ass", "попа", "попка"},
+		Args:    cmdArgsText,
+		Toggle:  "obutts",
+		Help:    "попка",
+	},
+}
+
+// commandRegistry - это реестр команд с поиском по имени и синонимам.
+type commandRegistry struct {
+	sync.RWMutex
+	// Команды из конфига или встроенные.
+	static []commandSpec
+	// Команды, которые объявили сервисы бота, см. command-discovery.go, они дополняют static и важнее их.
+	discovered []commandSpec
+	// Команды, которые действуют сейчас.
+	specs []commandSpec
+	// Имя или синоним команды -> её номер в specs.
+	index map[string]int
+}
+
+// newCommandRegistry создаёт реестр со встроенным списком команд.
+func newCommandRegistry() *commandRegistry {
+	registry := &commandRegistry{}
+	registry.Load(nil)
+
+	return registry
+}
+
+// Load заменяет команды из конфига, если specs пуст, то используется встроенный список.
+func (registry *commandRegistry) Load(specs []commandSpec) {
+	if len(specs) == 0 {
+		specs = defaultCommands
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	registry.static = specs
+	registry.rebuild()
+}
+
+// Discover заменяет команды, объявленные сервисами бота. Если specs пуст, то действуют только команды из конфига.
+func (registry *commandRegistry) Discover(specs []commandSpec) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	registry.discovered = specs
+	registry.rebuild()
+}
+
+// rebuild собирает действующие команды из static и discovered и пересобирает их индекс. Объявленная команда заменяет
+// команду из конфига с тем же именем на её месте в !help, а синонимы, занятые объявленными командами, у команд из
+// конфига отбираются. Остальные объявленные команды идут после команд из конфига. Повторяющиеся имена внутри static
+// или discovered не перетирают уже загруженные, их отлавливают проверка конфига и разбор объявлений сервисов.
+// Вызывается под блокировкой.
+func (registry *commandRegistry) rebuild() {
+	// Имя или синоним объявленной команды -> её номер в discovered
+	discovered := make(map[string]int)
+
+	for i, spec := range registry.discovered {
+		for _, name := range spec.Names() {
+			if _, ok := discovered[name]; !ok {
+				discovered[name] = i
+			}
+		}
+	}
+
+	specs := make([]commandSpec, 0, len(registry.static)+len(registry.discovered))
+	merged := make([]bool, len(registry.discovered))
+
+	for _, spec := range registry.static {
+		if i, ok := discovered[spec.Name]; ok {
+			if !merged[i] {
+				specs = append(specs, registry.discovered[i])
+				merged[i] = true
+			}
+
+			continue
+		}
+
+		spec.Aliases = slices.DeleteFunc(slices.Clone(spec.Aliases), func(alias string) bool {
+			_, ok := discovered[alias]
+
+			return ok
+		})
+
+		specs = append(specs, spec)
+	}
+
+	for i, spec := range registry.discovered {
+		if !merged[i] {
+			specs = append(specs, spec)
+		}
+	}
+
+	index := make(map[string]int)
+
+	for i, spec := range specs {
+		for _, name := range spec.Names() {
+			if _, ok := index[name]; !ok {
+				index[name] = i
+			}
+		}
+	}
+
+	registry.specs = specs
+	registry.index = index
+}
+
+// Lookup ищет команду по имени или синониму.
+func (registry *commandRegistry) Lookup(name string) (commandSpec, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	i, ok := registry.index[name]
+
+	if !ok {
+		return commandSpec{}, false
+	}
+
+	return registry.specs[i], true
+}
+
+// Toggled возвращает имена и синонимы команд отключаемого плагина feature.
+func (registry *commandRegistry) Toggled(feature string) []string {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	var names []string
+
+	for _, spec := range registry.specs {
+		if strings.EqualFold(spec.Toggle, feature) {
+			names = append(names, spec.Names()...)
+		}
+	}
+
+	return names
+}
+
+// Help возвращает строки !help для канала channel: команды отключаемых плагинов показываются, только если плагин на
+// этом канале включен.
+func (registry *commandRegistry) Help(csign string, channel string, mode string) []helpEntry {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	var entries []helpEntry
+
+	for _, spec := range registry.specs {
+		if spec.Help == "" || !commandAvailable(spec, channel, mode) {
+			continue
+		}
+
+		usage := csign + strings.Join(spec.Names(), " | "+csign)
+
+		if spec.Usage != "" {
+			usage += " " + spec.Usage
+		}
+
+		entries = append(entries, helpEntry{Usage: usage, Help: spec.Help})
+	}
+
+	return entries
+}
+
+// helpEntry - это строка !help: как вызвать команду и что она делает.
+type helpEntry struct {
+	Usage string
+	Help  string
+}
+
+// formatHelp выравнивает описания команд в !help в одну колонку.
+func formatHelp(entries []helpEntry) []string {
+	width := 0
+
+	for _, entry := range entries {
+		width = max(width, utf8.RuneCountInString(entry.Usage))
+	}
+
+	lines := make([]string, 0, len(entries))
+
+	// %-*s считает ширину в рунах, так что кириллица не сбивает выравнивание
+	for _, entry := range entries {
+		lines = append(lines, fmt.Sprintf("%-*s - %s", width, entry.Usage, entry.Help))
+	}
+
+	return lines
+}
+
+// Names возвращает имя команды и все её синонимы.
+func (spec commandSpec) Names() []string {
+	return append([]string{spec.Name}, spec.Aliases...)
+}
+
+// commandProblems проверяет описание команды из конфига или от сервиса where и проставляет в нём значения по
+// умолчанию. seen - это имена и синонимы уже проверенных команд и где они встретились, имена исправной команды туда
+// добавляются.
+func commandProblems(spec *commandSpec, where string, seen map[string]string) []string {
+	var problems []string
+
+	if spec.Name == "" {
+		problems = append(problems, "name must be set")
+	}
+
+	for _, name := range spec.Names() {
+		switch {
+		case name == "" || strings.ContainsAny(name, " \t"):
+			problems = append(problems, fmt.Sprintf("%q is not a valid command name", name))
+		case slices.Contains(reservedCommands, name):
+			problems = append(problems, name+" is a built-in command")
+		case seen[name] != "":
+			problems = append(problems, name+" is already used by "+seen[name])
+		}
+	}
+
+	switch spec.Args {
+	case "":
+		spec.Args = cmdArgsNone
+	case cmdArgsNone, cmdArgsText, cmdArgsNick:
+	default:
+		problems = append(problems, fmt.Sprintf("args must be %s, %s or %s, not %q", cmdArgsNone, cmdArgsText,
+			cmdArgsNick, spec.Args))
+	}
+
+	if _, ok := findToggle(spec.Toggle); spec.Toggle != "" && !ok {
+		problems = append(problems, "unknown plugin "+spec.Toggle)
+	}
+
+	if len(problems) == 0 {
+		for _, name := range spec.Names() {
+			seen[name] = where
+		}
+	}
+
+	return problems
+}
+
+// commandAvailable проверяет, можно ли пользоваться командой на канале: команды отключаемых плагинов доступны только
+// на канале, где плагин включен.
+func commandAvailable(spec commandSpec, channel string, mode string) bool {
+	if spec.Toggle == "" {
+		return true
+	}
+
+	feature, ok := findToggle(spec.Toggle)
+
+	return ok && mode == "public" && toggleEnabled(channel, feature)
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
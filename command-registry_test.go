@@ -0,0 +1,66 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCommandRegistryMerge(t *testing.T) {
+	registry := &commandRegistry{}
+	registry.Load([]commandSpec{
+		{Name: "anek", Aliases: []string{"анек"}, Help: "анекдот"},
+		{Name: "w", Aliases: []string{"погода", "weather"}, Args: cmdArgsText, Help: "погода из конфига"},
+		{Name: "ping", Aliases: []string{"пинг"}, Help: "пинг"},
+	})
+
+	registry.Discover([]commandSpec{
+		// Заменяет команду из конфига с тем же именем
+		{Name: "anek", Aliases: []string{"анекдот"}, Help: "анекдот от сервиса"},
+		// Забирает себе синоним команды из конфига
+		{Name: "meteo", Aliases: []string{"погода"}, Args: cmdArgsText, Help: "погода от сервиса"},
+		{Name: "coin", Help: "монетка"},
+	})
+
+	lookups := map[string]string{
+		"anek":    "анекдот от сервиса",
+		"анекдот": "анекдот от сервиса",
+		"w":       "погода из конфига",
+		"weather": "погода из конфига",
+		"погода":  "погода от сервиса",
+		"ping":    "пинг",
+		"coin":    "монетка",
+	}
+
+	for name, help := range lookups {
+		if spec, ok := registry.Lookup(name); !ok || spec.Help != help {
+			t.Errorf("Lookup(%q) = %+v, %t, want command %q", name, spec, ok, help)
+		}
+	}
+
+	// Синоним прежней версии команды пропадает вместе с ней
+	if spec, ok := registry.Lookup("анек"); ok {
+		t.Errorf("Lookup(анек) = %+v, want replaced command gone", spec)
+	}
+
+	var usage []string
+
+	for _, entry := range registry.Help("!", "#chan", "public") {
+		usage = append(usage, entry.Usage)
+	}
+
+	// Заменённая команда остаётся на своём месте, новые идут в конце
+	want := []string{"!anek | !анекдот", "!w | !weather", "!ping | !пинг", "!meteo | !погода", "!coin"}
+
+	if !slices.Equal(usage, want) {
+		t.Errorf("help %q, want %q", usage, want)
+	}
+
+	// Сервисы пропали - снова действуют только команды из конфига
+	registry.Discover(nil)
+
+	if spec, ok := registry.Lookup("погода"); !ok || spec.Name != "w" {
+		t.Errorf("Lookup(погода) = %+v, %t after services are gone, want w", spec, ok)
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* Перечитывание конфига на лету по SIGHUP. Большая часть настроек (ratelimit, csign, каналы, CTCP, приват, уровень и
+ * файл лога, nack-и и объявления команд в redis-ке) читается из конфига при каждом использовании, так что достаточно
+ * опубликовать новый конфиг и сделать JOIN/PART на изменившиеся каналы. Настройки соединений с сервером и redis-кой без
+ * переподключения не поменять, поэтому такие изменения не применяются, а в лог пишется, что для них нужен рестарт.
+ *
+ * Конфиг читают из многих горутин, поэтому он не меняется на месте: новый конфиг целиком публикуется через
+ * activeConfig, а читатели берут его снимок через currentConfig() и сами его не меняют.
+ */
+
+// currentConfig возвращает снимок действующего конфига, менять его нельзя.
+func currentConfig() *myConfig {
+	if config := activeConfig.Load(); config != nil {
+		return config
+	}
+
+	// Конфиг ещё не прочитан
+	return &myConfig{}
+}
+
+// setConfig публикует новый конфиг.
+func setConfig(config myConfig) {
+	activeConfig.Store(&config)
+}
+
+// reloadConfig перечитывает конфиг и применяет изменения. Если новый конфиг содержит ошибки, то остаётся старый.
+func reloadConfig() {
+	newConfig, location, err := readConfig()
+
+	if err != nil {
+		log.Errorf("Unable to reload config, keeping current one: %s", err)
+
+		return
+	}
+
+	problems := validateConfig(&newConfig)
+	logConfigProblems(location, problems)
+
+	if configHasErrors(problems) {
+		log.Errorf("Config %s has errors, keeping current one", location)
+
+		return
+	}
+
+	oldConfig := currentConfig()
+	keepConnectionSettings(&newConfig, *oldConfig)
+
+	// Опубликованный конфиг уже не меняется, поэтому лог переключаем до публикации
+	if newConfig.Log != oldConfig.Log {
+		if err := openLog(newConfig.Log); err != nil {
+			log.Errorf("Unable to switch log, keeping %s: %s", oldConfig.Log, err)
+
+			newConfig.Log = oldConfig.Log
+		}
+	}
+
+	setConfig(newConfig)
+	botCommands.Load(newConfig.Commands)
+	updateLogSecrets()
+	applyLogLevel()
+
+	// Ещё не успели подключиться к серверу, на каналы из нового конфига зайдём при подключении
+	if ircClient == nil {
+		log.Infof("Config %s reloaded", location)
+
+		return
+	}
+
+	syncChannels(oldConfig.Irc.Channels, newConfig.Irc.Channels)
+
+	log.Infof("Config %s reloaded", location)
+}
+
+// keepConnectionSettings возвращает в новый конфиг те настройки из текущего, которые нельзя поменять без
+// переподключения, и пишет в лог о каждой такой попытке.
+func keepConnectionSettings(newConfig *myConfig, current myConfig) {
+	keep := func(field string, changed bool) {
+		if changed {
+			log.Warnf("Config reload: %s can not be changed without restart, keeping current value", field)
+		}
+	}
+
+	// Прочие настройки redis-ки (nack, registry, max_len и claim_idle стримов) читаются при каждом использовании
+	keep("redis.server", newConfig.Redis.Server != current.Redis.Server)
+	keep("redis.port", newConfig.Redis.Port != current.Redis.Port)
+	keep("redis.channel", newConfig.Redis.Channel != current.Redis.Channel)
+	keep("redis.my_channel", newConfig.Redis.MyChannel != current.Redis.MyChannel)
+	keep("redis.username", newConfig.Redis.Username != current.Redis.Username)
+	keep("redis.password", newConfig.Redis.Password != current.Redis.Password)
+	keep("redis.database", newConfig.Redis.Database != current.Redis.Database)
+	keep("redis.tls", newConfig.Redis.Tls != current.Redis.Tls)
+	keep("redis.sentinel.master_name", newConfig.Redis.Sentinel.MasterName != current.Redis.Sentinel.MasterName)
+	keep("redis.sentinel.addrs", !slices.Equal(newConfig.Redis.Sentinel.Addrs, current.Redis.Sentinel.Addrs))
+	keep("redis.sentinel.username", newConfig.Redis.Sentinel.Username != current.Redis.Sentinel.Username)
+	keep("redis.sentinel.password", newConfig.Redis.Sentinel.Password != current.Redis.Sentinel.Password)
+	keep("redis.dial_timeout", newConfig.Redis.DialTimeout != current.Redis.DialTimeout)
+	keep("redis.read_timeout", newConfig.Redis.ReadTimeout != current.Redis.ReadTimeout)
+	keep("redis.transport", newConfig.Redis.Transport != current.Redis.Transport)
+	keep("redis.streams.group", newConfig.Redis.Streams.Group != current.Redis.Streams.Group)
+	keep("redis.streams.consumer", newConfig.Redis.Streams.Consumer != current.Redis.Streams.Consumer)
+	newConfig.Redis.Server = current.Redis.Server
+	newConfig.Redis.Port = current.Redis.Port
+	newConfig.Redis.Channel = current.Redis.Channel
+	newConfig.Redis.MyChannel = current.Redis.MyChannel
+	newConfig.Redis.Username = current.Redis.Username
+	newConfig.Redis.Password = current.Redis.Password
+	newConfig.Redis.PasswordEnv = current.Redis.PasswordEnv
+	newConfig.Redis.PasswordFile = current.Redis.PasswordFile
+	newConfig.Redis.Database = current.Redis.Database
+	newConfig.Redis.Tls = current.Redis.Tls
+	newConfig.Redis.Sentinel = current.Redis.Sentinel
+	newConfig.Redis.DialTimeout = current.Redis.DialTimeout
+	newConfig.Redis.ReadTimeout = current.Redis.ReadTimeout
+	newConfig.Redis.Transport = current.Redis.Transport
+	newConfig.Redis.Streams.Group = current.Redis.Streams.Group
+	newConfig.Redis.Streams.Consumer = current.Redis.Streams.Consumer
+
+	keep("irc.server", newConfig.Irc.Server != current.Irc.Server)
+	keep("irc.port", newConfig.Irc.Port != current.Irc.Port)
+	keep("irc.ssl", newConfig.Irc.Ssl != current.Irc.Ssl)
+	keep("irc.ssl_verify", newConfig.Irc.SslVerify != current.Irc.SslVerify)
+	keep("irc.nick", newConfig.Irc.Nick != current.Irc.Nick)
+	keep("irc.user", newConfig.Irc.User != current.Irc.User)
+	keep("irc.password", newConfig.Irc.Password != current.Irc.Password)
+	keep("irc.server_password", newConfig.Irc.ServerPassword != current.Irc.ServerPassword)
+	keep("irc.sasl", newConfig.Irc.Sasl != current.Irc.Sasl)
+	newConfig.Irc.Server = current.Irc.Server
+	newConfig.Irc.Port = current.Irc.Port
+	newConfig.Irc.Ssl = current.Irc.Ssl
+	newConfig.Irc.SslVerify = current.Irc.SslVerify
+	newConfig.Irc.Nick = current.Irc.Nick
+	newConfig.Irc.User = current.Irc.User
+	newConfig.Irc.Password = current.Irc.Password
+	newConfig.Irc.PasswordEnv = current.Irc.PasswordEnv
+	newConfig.Irc.PasswordFile = current.Irc.PasswordFile
+	newConfig.Irc.ServerPassword = current.Irc.ServerPassword
+	newConfig.Irc.ServerPasswordEnv = current.Irc.ServerPasswordEnv
+	newConfig.Irc.ServerPasswordFile = current.Irc.ServerPasswordFile
+	newConfig.Irc.Sasl = current.Irc.Sasl
+
+	// Базы с настройками уже открыты, а каталог с данными заблокирован этим инстансом
+	keep("data_dir", newConfig.DataDir != current.DataDir)
+	newConfig.DataDir = current.DataDir
+}
+
+// syncChannels заходит на каналы, которые появились в конфиге, и уходит с тех, которые из него пропали. О сменившемся
+// ключе канала, на котором мы уже есть, только пишет в лог.
+func syncChannels(oldChannels []channelConfig, newChannels []channelConfig) {
+	autojoined := func(channels []channelConfig, name string) bool {
+		return slices.ContainsFunc(channels, func(channel channelConfig) bool {
+			return channel.Autojoin && isupport.Equal(channel.Name, name)
+		})
+	}
+
+	for _, channel := range oldChannels {
+		if channel.Autojoin && !autojoined(newChannels, channel.Name) {
+			log.Infof("Channel %s is removed from config, leaving it", channel.Name)
+			ircPart(channel.Name)
+		}
+	}
+
+	for _, channel := range newChannels {
+		if !channel.Autojoin {
+			continue
+		}
+
+		i := slices.IndexFunc(oldChannels, func(old channelConfig) bool {
+			return old.Autojoin && isupport.Equal(old.Name, channel.Name)
+		})
+
+		switch {
+		case i < 0:
+			log.Infof("Channel %s is added to config, joining it", channel.Name)
+			ircJoin(channel.Name)
+		case oldChannels[i].Key != channel.Key:
+			// Мы уже на канале, ключ нужен только при входе на него, а ради ключа уходить с канала не стоит
+			log.Warnf("Key of channel %s is changed, it will be used after PART and JOIN of the channel or reconnect",
+				channel.Name)
+		}
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
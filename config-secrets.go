@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* Секреты в конфиге. Пароли не обязательно держать в конфиге открытым текстом: вместо поля password можно задать
+ * password_env с именем переменной окружения или password_file с путём к файлу (например, docker или k8s secret), из
+ * которого пароль будет прочитан. То же самое касается irc.server_password, redis.password и redis.sentinel.password.
+ *
+ * Чтобы секреты не утекали в логи (например, в отладочной записи об отправке identify в NickServ), форматтер logrus-а
+ * обёрнут в redactingFormatter, который заменяет известные ему секреты на заглушку.
+ */
+
+// Секреты короче этой длины не вымарываются из логов, иначе от логов ничего не останется.
+const minRedactedSecretLen = 3
+
+// secretField - это поле конфига с секретом и альтернативные источники его значения.
+type secretField struct {
+	// Путь к полю в конфиге, например, irc.password.
+	Field string
+	Value *string
+	// Имя переменной окружения, из которой берётся значение.
+	Env string
+	// Путь к файлу, из которого берётся значение.
+	File string
+}
+
+// configSecrets возвращает поля конфига, в которых хранятся секреты.
+func configSecrets(c *myConfig) []secretField {
+	return []secretField{
+		{"irc.password", &c.Irc.Password, c.Irc.PasswordEnv, c.Irc.PasswordFile},
+		{"irc.server_password", &c.Irc.ServerPassword, c.Irc.ServerPasswordEnv, c.Irc.ServerPasswordFile},
+		{"redis.password", &c.Redis.Password, c.Redis.PasswordEnv, c.Redis.PasswordFile},
+		{"redis.sentinel.password", &c.Redis.Sentinel.Password, c.Redis.Sentinel.PasswordEnv, c.Redis.Sentinel.PasswordFile},
+	}
+}
+
+// resolveSecrets подставляет значения секретов из переменных окружения и файлов.
+func resolveSecrets(c *myConfig, checker *configChecker) {
+	for _, secret := range configSecrets(c) {
+		sources := 0
+
+		for _, source := range []string{*secret.Value, secret.Env, secret.File} {
+			if source != "" {
+				sources++
+			}
+		}
+
+		if sources > 1 {
+			checker.warnf(secret.Field, "is set in more than one way, file wins over environment, which wins over config")
+		}
+
+		if secret.Env != "" {
+			value, ok := os.LookupEnv(secret.Env)
+
+			if !ok {
+				checker.errorf(secret.Field+"_env", "environment variable %s is not set", secret.Env)
+			}
+
+			*secret.Value = value
+		}
+
+		if secret.File != "" {
+			buf, err := os.ReadFile(secret.File)
+
+			if err != nil {
+				checker.errorf(secret.Field+"_file", "unable to read secret: %s", err)
+
+				continue
+			}
+
+			// Файлы с секретами обычно заканчиваются переводом строки, который к секрету не относится.
+			*secret.Value = strings.TrimRight(string(buf), "\r\n")
+		}
+	}
+}
+
+// redactingFormatter - это обёртка над форматтером logrus-а, вымарывающая секреты из записей лога.
+type redactingFormatter struct {
+	log.Formatter
+	sync.RWMutex
+	replacer *strings.Replacer
+}
+
+// Format вымарывает секреты из записи лога и передаёт её настоящему форматтеру.
+func (formatter *redactingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	formatter.RLock()
+	replacer := formatter.replacer
+	formatter.RUnlock()
+
+	if replacer != nil {
+		entry.Message = replacer.Replace(entry.Message)
+
+		for key, value := range entry.Data {
+			if s, ok := value.(string); ok {
+				entry.Data[key] = replacer.Replace(s)
+			}
+		}
+	}
+
+	return formatter.Formatter.Format(entry)
+}
+
+// SetSecrets задаёт список секретов, которые надо вымарывать.
+func (formatter *redactingFormatter) SetSecrets(secrets []string) {
+	var pairs []string
+
+	for _, secret := range secrets {
+		if len(secret) >= minRedactedSecretLen {
+			pairs = append(pairs, secret, redactedValue)
+		}
+	}
+
+	formatter.Lock()
+	defer formatter.Unlock()
+
+	if len(pairs) == 0 {
+		formatter.replacer = nil
+
+		return
+	}
+
+	formatter.replacer = strings.NewReplacer(pairs...)
+}
+
+// updateLogSecrets сообщает форматтеру лога секреты из текущего конфига.
+func updateLogSecrets() {
+	var secrets []string
+
+	// configSecrets отдаёт указатели на поля, поэтому работаем с копией, а не с опубликованным конфигом
+	config := *currentConfig()
+
+	for _, secret := range configSecrets(&config) {
+		secrets = append(secrets, *secret.Value)
+	}
+
+	for _, channel := range config.Irc.Channels {
+		secrets = append(secrets, channel.Key)
+	}
+
+	logFormatter.SetSecrets(secrets)
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* Проверка конфига. Вместо того, чтобы падать на первой же ошибке, validateConfig проходит по всему конфигу, собирает
+ * все проблемы с путями к полям (например, irc.ratelimit.token_bucket.size) и заодно выставляет default-ы. Ошибка -
+ * это то, с чем бот работать не может, предупреждение - значение, которое бот заменил на своё.
+ */
+
+// Уровни серьёзности проблем в конфиге.
+const (
+	configError   = "error"
+	configWarning = "warning"
+)
+
+// Чем заменяются секреты при выводе конфига.
+const redactedValue = "*****"
+
+// configProblem - это одна проблема в конфиге.
+type configProblem struct {
+	Severity string
+	// Путь к полю в конфиге, например, irc.channels[1].name.
+	Field   string
+	Message string
+}
+
+// String форматирует проблему для вывода.
+func (problem configProblem) String() string {
+	return fmt.Sprintf("%s: %s: %s", problem.Severity, problem.Field, problem.Message)
+}
+
+// configChecker копит проблемы, найденные при проверке конфига.
+type configChecker struct {
+	problems []configProblem
+}
+
+// errorf добавляет ошибку в поле field.
+func (checker *configChecker) errorf(field string, format string, args ...any) {
+	checker.problems = append(checker.problems, configProblem{configError, field, fmt.Sprintf(format, args...)})
+}
+
+// warnf добавляет предупреждение в поле field.
+func (checker *configChecker) warnf(field string, format string, args ...any) {
+	checker.problems = append(checker.problems, configProblem{configWarning, field, fmt.Sprintf(format, args...)})
+}
+
+// validateConfig проверяет конфиг и выставляет default-ы для незаданных значений. Возвращает все найденные проблемы.
+func validateConfig(c *myConfig) []configProblem { //nolint: gocyclo
+	var checker configChecker
+
+	resolveSecrets(c, &checker)
+
+	// Значения для redis-ки
+	if c.Redis.Server == "" {
+		c.Redis.Server = "localhost"
+	}
+
+	if c.Redis.Port == 0 {
+		c.Redis.Port = 6379
+	} else if c.Redis.Port < 0 || c.Redis.Port > 65535 {
+		checker.errorf("redis.port", "%d is not a valid port", c.Redis.Port)
+	}
+
+	if c.Redis.Channel == "" {
+		checker.errorf("redis.channel", "must be set")
+	}
+
+	if c.Redis.MyChannel == "" {
+		checker.errorf("redis.my_channel", "must be set")
+	} else if c.Redis.MyChannel == c.Redis.Channel {
+		checker.errorf("redis.my_channel", "must differ from redis.channel, otherwise bot will read its own messages")
+	}
+
+	validateRedis(c, &checker)
+
+	// Значения для IRC-клиента
+	if c.Irc.Server == "" {
+		c.Irc.Server = "localhost"
+
+		checker.warnf("irc.server", "is not set, using localhost")
+	}
+
+	if c.Irc.Port == 0 {
+		c.Irc.Port = 6667
+	} else if c.Irc.Port < 0 || c.Irc.Port > 65535 {
+		checker.errorf("irc.port", "%d is not a valid port", c.Irc.Port)
+	}
+
+	if !c.Irc.Ssl && c.Irc.SslVerify {
+		c.Irc.SslVerify = false
+
+		checker.warnf("irc.ssl_verify", "has no effect without irc.ssl")
+	}
+
+	if c.Irc.Nick == "" {
+		checker.errorf("irc.nick", "must be set")
+	} else if strings.ContainsAny(c.Irc.Nick, " ,*?!@") || strings.ContainsAny(c.Irc.Nick[:1], "#&:$0123456789-") {
+		checker.errorf("irc.nick", "%q is not a valid nick", c.Irc.Nick)
+	}
+
+	if c.Irc.User == "" {
+		c.Irc.User = c.Irc.Nick
+	}
+
+	// Если c.Irc.Password не задан, то авторизации через Nickserv или SASL не будет
+	// Если c.Irc.Sasl не задан, то авторизация происходит через NickServ
+	if c.Irc.Sasl && c.Irc.Password == "" {
+		checker.warnf("irc.sasl", "is set, but irc.password is empty, sasl authentication is disabled")
+	}
+
+	validateChannels(c, &checker)
+	validateRateLimit(c, &checker)
+
+	if c.Irc.QuitMessage == "" {
+		c.Irc.QuitMessage = defaultQuitMessage
+	}
+
+	if c.Irc.Ctcp.Version == "" {
+		c.Irc.Ctcp.Version = defaultCtcpVersion
+	}
+
+	// Если c.Irc.Ctcp.Source не задан, то на CTCP SOURCE бот не отвечает
+
+	if c.Irc.Ctcp.Userinfo == "" {
+		c.Irc.Ctcp.Userinfo = c.Irc.User
+	}
+
+	for i, command := range c.Irc.Ctcp.Disabled {
+		if !slices.Contains(ctcpCommands, strings.ToUpper(command)) {
+			checker.warnf(fmt.Sprintf("irc.ctcp.disabled[%d]", i), "unknown CTCP command %s", command)
+		}
+	}
+
+	if len(c.Irc.Services) == 0 {
+		c.Irc.Services = defaultServices
+	}
+
+	if c.Irc.Private.RateLimit.Messages < 1 {
+		if c.Irc.Private.RateLimit.Messages < 0 {
+			checker.warnf("irc.private.ratelimit.messages", "must be positive, using 5")
+		}
+
+		c.Irc.Private.RateLimit.Messages = 5
+	}
+
+	if c.Irc.Private.RateLimit.Period < 1 {
+		if c.Irc.Private.RateLimit.Period < 0 {
+			checker.warnf("irc.private.ratelimit.period", "must be positive, using 60")
+		}
+
+		c.Irc.Private.RateLimit.Period = 60
+	}
+
+	if c.Irc.Private.DailyQuota < 1 {
+		if c.Irc.Private.DailyQuota < 0 {
+			checker.warnf("irc.private.daily_quota", "must be positive, using 100")
+		}
+
+		c.Irc.Private.DailyQuota = 100
+	}
+
+	validateAdmin(c, &checker)
+
+	if c.Loglevel == "" {
+		c.Loglevel = "info"
+	} else if !slices.Contains([]string{"fatal", "error", "warn", "info", "debug"}, c.Loglevel) {
+		checker.warnf("loglevel", "unknown level %s, using info", c.Loglevel)
+
+		c.Loglevel = "info"
+	}
+
+	// c.Log = "" if not set
+
+	if c.Csign == "" {
+		checker.errorf("csign", "must be set")
+	}
+
+	if c.ForwardsMax == 0 {
+		c.ForwardsMax = forwardMax
+	} else if c.ForwardsMax < 0 {
+		checker.warnf("forwards_max", "must be positive, using %d", forwardMax)
+
+		c.ForwardsMax = forwardMax
+	}
+
+	if c.DataDir == "" {
+		checker.errorf("data_dir", "must be set")
+	}
+
+	validateCommands(c, &checker)
+
+	return checker.problems
+}
+
+// validateCommands проверяет реестр команд, см. command-registry.go.
+func validateCommands(c *myConfig, checker *configChecker) {
+	// Имя или синоним -> команда, в которой они уже встречались
+	seen := make(map[string]string)
+
+	for i := range c.Commands {
+		field := fmt.Sprintf("commands[%d]", i)
+
+		for _, problem := range commandProblems(&c.Commands[i], field, seen) {
+			checker.errorf(field, "%s", problem)
+		}
+	}
+}
+
+// validateAdmin проверяет владельцев бота и права операторов каналов.
+func validateAdmin(c *myConfig, checker *configChecker) {
+	if c.Irc.Admin.OpsAreAdmins == nil {
+		opsAreAdmins := true
+		c.Irc.Admin.OpsAreAdmins = &opsAreAdmins
+	}
+
+	for i, mask := range c.Irc.Admin.Owners {
+		if !strings.HasPrefix(mask, "$a:") && !strings.Contains(mask, "!") {
+			checker.warnf(fmt.Sprintf("irc.admin.owners[%d]", i), "%q is neither nick!user@host nor $a:account mask", mask)
+		}
+	}
+
+	if len(c.Irc.Admin.Owners) == 0 && !aclOpsAreAdmins(c) {
+		checker.warnf("irc.admin", "no owners and ops are not admins, nobody can use admin commands")
+	}
+}
+
+// validateRedis проверяет настройки соединения с redis-кой.
+func validateRedis(c *myConfig, checker *configChecker) {
+	if c.Redis.Database < 0 {
+		checker.errorf("redis.database", "must not be negative")
+	}
+
+	if c.Redis.Sentinel.MasterName != "" && len(c.Redis.Sentinel.Addrs) == 0 {
+		checker.errorf("redis.sentinel.addrs", "at least one sentinel must be defined for master %s",
+			c.Redis.Sentinel.MasterName)
+	}
+
+	if c.Redis.Sentinel.MasterName == "" && len(c.Redis.Sentinel.Addrs) > 0 {
+		checker.warnf("redis.sentinel.master_name", "is not set, sentinels are ignored")
+	}
+
+	if (c.Redis.Tls.CertFile == "") != (c.Redis.Tls.KeyFile == "") {
+		checker.errorf("redis.tls", "cert_file and key_file must be set together")
+	}
+
+	if !c.Redis.Tls.Enabled && (c.Redis.Tls.CaFile != "" || c.Redis.Tls.CertFile != "") {
+		checker.warnf("redis.tls.enabled", "is not set, tls settings are ignored")
+	}
+
+	for field, path := range map[string]string{
+		"redis.tls.ca_file":   c.Redis.Tls.CaFile,
+		"redis.tls.cert_file": c.Redis.Tls.CertFile,
+		"redis.tls.key_file":  c.Redis.Tls.KeyFile,
+	} {
+		if _, err := os.Stat(path); path != "" && err != nil {
+			checker.errorf(field, "%s", err)
+		}
+	}
+
+	validateRedisTransport(c, checker)
+
+	if c.Redis.DialTimeout < 0 {
+		checker.warnf("redis.dial_timeout", "must not be negative, using default")
+
+		c.Redis.DialTimeout = 0
+	}
+
+	if c.Redis.ReadTimeout < 0 {
+		checker.warnf("redis.read_timeout", "must not be negative, using default")
+
+		c.Redis.ReadTimeout = 0
+	}
+
+	if c.Redis.Registry.Refresh < 1 {
+		if c.Redis.Registry.Refresh < 0 {
+			checker.warnf("redis.registry.refresh", "must be positive, using %d", defaultRegistryRefresh)
+		}
+
+		c.Redis.Registry.Refresh = defaultRegistryRefresh
+	}
+}
+
+// validateRedisTransport проверяет способ доставки сообщений через redis-ку и настройки стримов.
+func validateRedisTransport(c *myConfig, checker *configChecker) {
+	for field, transport := range map[string]*string{
+		"redis.transport.incoming": &c.Redis.Transport.Incoming,
+		"redis.transport.outgoing": &c.Redis.Transport.Outgoing,
+	} {
+		*transport = strings.ToLower(*transport)
+
+		switch *transport {
+		case "":
+			*transport = transportPubsub
+		case transportPubsub, transportStreams:
+		default:
+			checker.errorf(field, "unknown transport %q, must be %s or %s", *transport, transportPubsub, transportStreams)
+		}
+	}
+
+	if c.Redis.Streams.Group == "" {
+		c.Redis.Streams.Group = defaultStreamGroup
+	}
+
+	if c.Redis.Streams.Consumer == "" {
+		hostname, err := os.Hostname()
+
+		if err != nil {
+			hostname = defaultBinaryName
+		}
+
+		c.Redis.Streams.Consumer = hostname
+	}
+
+	if c.Redis.Streams.MaxLen == 0 {
+		c.Redis.Streams.MaxLen = defaultStreamMaxLen
+	} else if c.Redis.Streams.MaxLen < 0 {
+		checker.warnf("redis.streams.max_len", "must not be negative, using %d", defaultStreamMaxLen)
+
+		c.Redis.Streams.MaxLen = defaultStreamMaxLen
+	}
+
+	if c.Redis.Streams.ClaimIdle == 0 {
+		c.Redis.Streams.ClaimIdle = defaultStreamClaimIdle
+	} else if c.Redis.Streams.ClaimIdle < 0 {
+		checker.warnf("redis.streams.claim_idle", "must not be negative, using %d", defaultStreamClaimIdle)
+
+		c.Redis.Streams.ClaimIdle = defaultStreamClaimIdle
+	}
+}
+
+// validateChannels проверяет список каналов.
+func validateChannels(c *myConfig, checker *configChecker) {
+	// Нам бот нужен на каких-то IRC-каналах, а не "просто так"
+	if len(c.Irc.Channels) < 1 {
+		checker.errorf("irc.channels", "at least one channel must be defined")
+
+		return
+	}
+
+	autojoin := false
+	// CASEMAPPING сервера нам ещё неизвестен, так что сравниваем по умолчальному rfc1459, он самый широкий
+	features := newServerFeatures()
+
+	for i, channel := range c.Irc.Channels {
+		field := fmt.Sprintf("irc.channels[%d]", i)
+
+		if strings.ContainsAny(channel.Name, " ,\x07") {
+			checker.errorf(field+".name", "%q is not a valid channel name", channel.Name)
+		}
+
+		if strings.ContainsAny(channel.Key, " ,") {
+			checker.errorf(field+".key", "channel key must not contain spaces or commas")
+		}
+
+		if channel.RateLimit.SimpleDelay < 0 {
+			checker.warnf(field+".ratelimit.simple_delay", "must be positive, ignoring")
+
+			c.Irc.Channels[i].RateLimit.SimpleDelay = 0
+		}
+
+		if slices.ContainsFunc(c.Irc.Channels[:i], func(other channelConfig) bool {
+			return features.Equal(other.Name, channel.Name)
+		}) {
+			checker.warnf(field+".name", "channel %s is defined more than once, only first definition is used", channel.Name)
+		}
+
+		autojoin = autojoin || channel.Autojoin
+	}
+
+	if !autojoin {
+		checker.warnf("irc.channels", "no channel has autojoin enabled, bot will not join anywhere")
+	}
+}
+
+// validateRateLimit проверяет настройки ограничения скорости отправки сообщений.
+func validateRateLimit(c *myConfig, checker *configChecker) {
+	rateLimit := &c.Irc.RateLimit
+
+	switch rateLimit.Type {
+	case "none", "simple_delay", "token_bucket":
+	case "":
+		rateLimit.Type = "none"
+	default:
+		checker.warnf("irc.ratelimit.type", "unknown type %s, using none", rateLimit.Type)
+
+		rateLimit.Type = "none"
+	}
+
+	// Если не задано, то 50мс; если менее 50мс, то 50мс
+	if rateLimit.SimpleDelay < 50 {
+		if rateLimit.SimpleDelay != 0 {
+			checker.warnf("irc.ratelimit.simple_delay", "%d is less than 50ms, using 50ms", rateLimit.SimpleDelay)
+		}
+
+		rateLimit.SimpleDelay = 50
+	}
+
+	if rateLimit.Type == "token_bucket" {
+		bucket := &rateLimit.TokenBucket
+
+		if bucket.Size < 3 {
+			if bucket.Size != 0 {
+				checker.warnf("irc.ratelimit.token_bucket.size", "%d is less than 3, using 5", bucket.Size)
+			}
+
+			bucket.Size = 5
+		}
+
+		if bucket.Limit < 1 {
+			if bucket.Limit != 0 {
+				checker.warnf("irc.ratelimit.token_bucket.limit", "must be positive, using 1")
+			}
+
+			bucket.Limit = 1
+		}
+
+		if bucket.Size < bucket.Limit {
+			checker.warnf("irc.ratelimit.token_bucket", "size %d is less than limit %d, using size 5 and limit 1",
+				bucket.Size, bucket.Limit)
+
+			bucket.Size = 5
+			bucket.Limit = 1
+		}
+
+		if bucket.ExpirationTime < 2 {
+			if bucket.ExpirationTime != 0 {
+				checker.warnf("irc.ratelimit.token_bucket.expiration_time", "%d is less than 2, using 2",
+					bucket.ExpirationTime)
+			}
+
+			bucket.ExpirationTime = 2
+		}
+	}
+
+	if rateLimit.DrainTimeout < 1 {
+		if rateLimit.DrainTimeout != 0 {
+			checker.warnf("irc.ratelimit.drain_timeout", "must be positive, using %d", defaultDrainTimeout)
+		}
+
+		rateLimit.DrainTimeout = defaultDrainTimeout
+	}
+
+	if rateLimit.QueueDepth < 1 {
+		if rateLimit.QueueDepth != 0 {
+			checker.warnf("irc.ratelimit.queue_depth", "must be positive, using %d", defaultQueueDepth)
+		}
+
+		rateLimit.QueueDepth = defaultQueueDepth
+	}
+}
+
+// configHasErrors проверяет, есть ли среди проблем хоть одна ошибка.
+func configHasErrors(problems []configProblem) bool {
+	return slices.ContainsFunc(problems, func(problem configProblem) bool {
+		return problem.Severity == configError
+	})
+}
+
+// logConfigProblems пишет проблемы в конфиге в лог.
+func logConfigProblems(location string, problems []configProblem) {
+	for _, problem := range problems {
+		if problem.Severity == configError {
+			log.Errorf("Config %s: %s: %s", location, problem.Field, problem.Message)
+		} else {
+			log.Warnf("Config %s: %s: %s", location, problem.Field, problem.Message)
+		}
+	}
+}
+
+// redactConfig возвращает копию конфига, в которой секреты заменены на заглушки.
+func redactConfig(c myConfig) myConfig {
+	for _, secret := range configSecrets(&c) {
+		if *secret.Value != "" {
+			*secret.Value = redactedValue
+		}
+	}
+
+	c.Irc.Channels = slices.Clone(c.Irc.Channels)
+
+	for i := range c.Irc.Channels {
+		if c.Irc.Channels[i].Key != "" {
+			c.Irc.Channels[i].Key = redactedValue
+		}
+	}
+
+	return c
+}
+
+// dumpConfig выводит конфиг со всеми default-ами и без секретов.
+func dumpConfig(w io.Writer, c myConfig) error {
+	data, err := json.MarshalIndent(redactConfig(c), "", "\t")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(w, string(data))
+
+	return err
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
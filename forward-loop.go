@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* Защита от зацикливания пересылки сообщений. Каждое сообщение несёт в Misc.fwd_cnt счётчик пересылок, и если он больше
+ * forwards_max, то сообщение выкидывается. Сообщения из шины с превышенным счётчиком в IRC не отправляются, а
+ * отправленные в IRC запоминаются на forwardEchoTTL вместе со счётчиком. Если такой текст потом вернётся к нам из IRC
+ * (его повторил другой фронт-энд aleesa-bot-а или переслал мост из другой сети, возможно, дописав ник спереди), то это
+ * пересылка, и роутеру он уйдёт со счётчиком на единицу больше. Так два фронт-энда не смогут отвечать друг другу до
+ * бесконечности. Текст должен совпасть со строкой целиком, не считая ника спереди, иначе человека, который процитировал
+ * бота, мы бы приняли за пересылку. Собственные сообщения, которые сервер вернул нам же (например, с echo-message), не
+ * пересылаются вовсе.
+ *
+ * Счётчики выкинутых сообщений раз в forwardStatsInterval пишутся в лог, если с прошлого раза они изменились.
+ */
+
+const (
+	// Сколько помним отправленный в IRC текст.
+	forwardEchoTTL = 5 * time.Minute
+	// Сколько отправленных текстов помним максимум.
+	forwardEchoMax = 1000
+	// Как часто пишем в лог счётчики выкинутых сообщений.
+	forwardStatsInterval = 10 * time.Minute
+)
+
+// Счётчики сообщений, выкинутых защитой от зацикливания, по направлениям: incoming - из шины в IRC, outgoing - из IRC
+// в шину, echo - наши же сообщения, вернувшиеся из IRC.
+var forwardDrops = expvar.NewMap("forward_loop_drops")
+
+// Ник, который мосты дописывают спереди пересылаемого текста: "<nick> текст", "[nick] текст" или "nick: текст".
+var forwardNickPrefix = regexp.MustCompile(`^(<[^ >]+>|\[[^ \]]+\]|[^ :]+:) `)
+
+// forwardEcho - это текст, отправленный в IRC, и его счётчик пересылок.
+type forwardEcho struct {
+	text   string
+	fwdcnt int64
+	sent   time.Time
+}
+
+// forwardTracker помнит недавно отправленные в IRC тексты, чтобы узнать их, если они к нам вернутся.
+type forwardTracker struct {
+	sync.Mutex
+	// Упорядочены по времени отправки, самые старые в начале.
+	recent []forwardEcho
+}
+
+// newForwardTracker создаёт пустой forwardTracker.
+func newForwardTracker() *forwardTracker {
+	return &forwardTracker{}
+}
+
+// Remember запоминает текст, отправленный в IRC со счётчиком пересылок fwdcnt.
+func (t *forwardTracker) Remember(text string, fwdcnt int64, now time.Time) {
+	text = forwardNormalize(text)
+
+	if text == "" {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.expire(now)
+
+	if len(t.recent) >= forwardEchoMax {
+		t.recent = t.recent[1:]
+	}
+
+	t.recent = append(t.recent, forwardEcho{text: text, fwdcnt: fwdcnt, sent: now})
+}
+
+// Lookup проверяет, не является ли text пересылкой недавно отправленного нами текста, и возвращает счётчик пересылок
+// этого текста.
+func (t *forwardTracker) Lookup(text string, now time.Time) (int64, bool) {
+	text = forwardNormalize(text)
+	unprefixed := forwardNickPrefix.ReplaceAllString(text, "")
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.expire(now)
+
+	for i := len(t.recent) - 1; i >= 0; i-- {
+		echo := t.recent[i]
+
+		if text == echo.text || unprefixed == echo.text {
+			return echo.fwdcnt, true
+		}
+	}
+
+	return 0, false
+}
+
+// expire забывает тексты старше forwardEchoTTL.
+func (t *forwardTracker) expire(now time.Time) {
+	i := 0
+
+	for i < len(t.recent) && now.Sub(t.recent[i].sent) > forwardEchoTTL {
+		i++
+	}
+
+	t.recent = t.recent[i:]
+}
+
+// forwardNormalize убирает из текста коды форматирования и лишние пробелы: мосты любят раскрашивать пересылаемое.
+func forwardNormalize(text string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\x03', '\x04':
+			i = formatCodeEnd(text, i) - 1
+		case '\x02', '\x0f', '\x11', '\x16', '\x1d', '\x1e', '\x1f':
+		default:
+			b.WriteByte(text[i])
+		}
+	}
+
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// forwardAllowed проверяет счётчик пересылок сообщения, которое идёт в направлении direction, и учитывает выкинутые.
+func forwardAllowed(direction string, fwdcnt int64) bool {
+	config := currentConfig()
+
+	if fwdcnt <= config.ForwardsMax {
+		return true
+	}
+
+	forwardDrops.Add(direction, 1)
+
+	return false
+}
+
+// forwardStats пишет в лог счётчики выкинутых сообщений, если они изменились, пока не отменён ctx.
+func forwardStats(ctx context.Context) {
+	// Пока ничего не выкидывали, в лог ничего и не пишем
+	previous := forwardDrops.String()
+
+	for sleep(ctx, forwardStatsInterval) {
+		if current := forwardDrops.String(); current != previous {
+			log.Infof("Messages dropped by forward loop protection: %s", current)
+
+			previous = current
+		}
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
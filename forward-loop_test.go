@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestForwardTrackerLookup(t *testing.T) {
+	now := time.Now()
+
+	tracker := newForwardTracker()
+	tracker.Remember("Погода в Москве: +5, ясно", 2, now)
+	tracker.Remember("ok", 1, now)
+
+	tests := []struct {
+		name    string
+		text    string
+		forward bool
+	}{
+		{"same text", "Погода в Москве: +5, ясно", true},
+		{"bridge with angle brackets", "<aleesa> Погода в Москве: +5, ясно", true},
+		{"bridge with square brackets", "[aleesa] Погода в Москве: +5, ясно", true},
+		{"nick prefix", "aleesa: Погода в Москве: +5, ясно", true},
+		{"colored by bridge", "\x0304<aleesa>\x03 Погода в Москве: \x02+5\x02, ясно", true},
+		{"short text", "ok", true},
+		// Человек процитировал бота, это не пересылка
+		{"human quoting bot", "бот говорит Погода в Москве: +5, ясно, а за окном снег", false},
+		{"human quoting bot after nick", "bob: она сказала Погода в Москве: +5, ясно", false},
+		{"short text in phrase", "ok, понял", false},
+		{"unknown text", "Погода в Питере: +3, дождь", false},
+	}
+
+	for _, test := range tests {
+		fwdcnt, ok := tracker.Lookup(test.text, now)
+
+		if ok != test.forward {
+			t.Errorf("%s: Lookup(%q) = %d, %t, want %t", test.name, test.text, fwdcnt, ok, test.forward)
+		}
+	}
+
+	if _, ok := tracker.Lookup("ok", now.Add(forwardEchoTTL+time.Second)); ok {
+		t.Error("Lookup() found text older than forwardEchoTTL")
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
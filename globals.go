@@ -3,17 +3,29 @@ package main
 import (
 	"context"
 	"os"
+	"sync/atomic"
 
-	"aleesa-irc-go/internal/anycollection"
 	"aleesa-irc-go/internal/boolcollection"
 
 	"github.com/cockroachdb/pebble"
-	"github.com/go-redis/redis/v8"
 	irc "github.com/thoj/go-ircevent"
 )
 
-// Config - это у нас глобальная штука :).
-var config myConfig
+// Config - это у нас глобальная штука :). При перечитывании он подменяется целиком из хэндлера сигналов, а читают его
+// из многих горутин, поэтому читатели берут снимок через currentConfig(), см. config-reload.go.
+var activeConfig atomic.Pointer[myConfig]
+
+// Форматтер лога, вымарывающий из него секреты.
+var logFormatter = &redactingFormatter{}
+
+// Параметры командной строки.
+var cmdline cmdlineFlags
+
+// Файл, в который пишется лог, nil - если лог идёт в STDOUT.
+var logFile *os.File
+
+// Файл блокировки каталога с данными, держится открытым всё время работы.
+var dataDirLock *os.File
 
 // To break circular message forwarding we must set some sane default, it can be overridden via config.
 var forwardMax int64 = 5
@@ -22,33 +34,42 @@ var forwardMax int64 = 5
 var ircClient *irc.Connection
 var nickIsUsed = false
 
-// Объектики клиента-редиски.
-var redisClient *redis.Client
-var subscriber *redis.PubSub
+// Шина сообщений между нами и роутером.
+var bus messageBus
 
-// Main context.
-var ctx = context.Background()
+// Main context, отменяется, когда мы получили сигнал на выключение.
+var ctx, stopApp = context.WithCancel(context.Background())
 
-// Ставится в true, если мы получили сигнал на выключение.
-var shutdown = false
+// Контекст отправки сообщений в IRC. Он отменяется позже основного, чтобы при выключении успеть отправить то, что уже
+// накопилось в очереди.
+var senderCtx, stopSender = context.WithCancel(context.Background())
+
+// Закрывается, когда горутинка irc-клиента завершила работу.
+var ircDone = make(chan struct{})
 
 // Канал, в который приходят уведомления для хэндлера сигналов от траппера сигналов.
 var sigChan = make(chan os.Signal, 1)
 
-// Канал, в который пишутся сообщения для отправки в IRC в обычном порядке.
-var imChan = make(chan iMsg, 10000)
+// Планировщик исходящих сообщений в IRC.
+var sender = newSendScheduler()
 
-// Канал, в который пишутся сообщения для отправки в IRC, если ограничений нет (у бота +o или +v на канале).
-var imChanUnrestricted = make(chan iMsg, 100)
+// Недавно отправленные в IRC тексты для защиты от зацикливания пересылки.
+var forwardEchoes = newForwardTracker()
 
-// "Ведёрко" с timestamp-ами последних отправленных сообщений.
-var msgBucket bucket
+// Учёт сообщений в привате по пользователям.
+var privateUsers = newPrivateLimiter()
 
 // Мапка с открытыми дескрипторами баз с настройками.
 var settingsDB = make(map[string]*pebble.DB)
 
-// "Базюлька" с MODE-ами пользователей на каналах.
-var userMode = anycollection.NewCollection()
+// Состояние каналов, на которых есть бот, с их участниками и MODE-ами.
+var chanState = newChanStateTracker()
+
+// Реестр команд, которые пересылаются в router.
+var botCommands = newCommandRegistry()
+
+// Опознание отправителей команд !admin.
+var identities = newIdentityResolver()
 
 // "Базюлька" с доступными MODE-ами пользователя.
 var availableUserModes = boolcollection.NewCollection()
@@ -56,4 +77,7 @@ var availableUserModes = boolcollection.NewCollection()
 // "Базюлька" c с доступными MODE-ами каналов.
 var availableChanModes = boolcollection.NewCollection()
 
+// Реестр возможностей сервера из 005 RPL_ISUPPORT.
+var isupport = newServerFeatures()
+
 /* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
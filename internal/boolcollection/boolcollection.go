@@ -49,6 +49,15 @@ func (collection *Collection) Delete(key string) {
 	collection.items.Delete(key)
 }
 
+// Clear удаляет из коллекции все ключи, коллекцией при этом можно продолжать пользоваться.
+func (collection *Collection) Clear() {
+	collection.items.Range(func(key, _ any) bool {
+		collection.items.Delete(key)
+
+		return true
+	})
+}
+
 // Close очищает и высвобождает ресурсы, занятые коллекцией.
 func (collection *Collection) Close() {
 	collection.close <- struct{}{}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* Права на команду !admin, см. DESIGN. Владельцы бота задаются в конфиге масками nick!user@host или $a:account и
+ * являются админами на всех каналах. Админы и доверенные участники канала хранятся в базе настроек канала (см.
+ * settings-db-util.go) под ключом acl в виде json-а {"маска": "роль"}. Операторы канала, если это не выключено в
+ * конфиге, тоже считаются админами этого канала.
+ *
+ * Доверенные участники могут настраивать плагины канала. Админы канала, кроме того, могут добавлять и удалять
+ * доверенных участников, но не себя. Назначать и снимать админов может только владелец.
+ */
+
+// aclRole - это роль пользователя на канале, роли упорядочены по возрастанию прав.
+type aclRole int
+
+const (
+	roleNone aclRole = iota
+	roleTrusted
+	roleAdmin
+	roleOwner
+)
+
+// Ключ в базе настроек канала, под которым лежит его acl.
+const aclSetting = "acl"
+
+// String возвращает название роли так, как оно хранится в базе и пишется в командах.
+func (role aclRole) String() string {
+	switch role {
+	case roleTrusted:
+		return "trusted"
+	case roleAdmin:
+		return "admin"
+	case roleOwner:
+		return "owner"
+	default:
+		return "none"
+	}
+}
+
+// parseACLRole разбирает название роли, владельца в базе канала быть не может.
+func parseACLRole(name string) (aclRole, bool) {
+	switch strings.ToLower(name) {
+	case "trusted":
+		return roleTrusted, true
+	case "admin":
+		return roleAdmin, true
+	default:
+		return roleNone, false
+	}
+}
+
+// aclCaller - это тот, кто прислал команду: его ник, маска nick!user@host и services account, если он известен.
+type aclCaller struct {
+	Nick    string
+	Source  string
+	Account string
+}
+
+// aclEntries возвращает acl канала: маски и их роли.
+func aclEntries(channel string) map[string]aclRole {
+	entries := make(map[string]aclRole)
+	value := getSetting(channel, aclSetting)
+
+	if value == "" {
+		return entries
+	}
+
+	var stored map[string]string
+
+	if err := json.Unmarshal([]byte(value), &stored); err != nil {
+		log.Errorf("Unable to parse acl of %s: %s", channel, err)
+
+		return entries
+	}
+
+	for mask, name := range stored {
+		if role, ok := parseACLRole(name); ok {
+			entries[mask] = role
+		} else {
+			log.Warnf("Unknown role %s for %s in acl of %s", name, mask, channel)
+		}
+	}
+
+	return entries
+}
+
+// aclSave сохраняет acl канала.
+func aclSave(channel string, entries map[string]aclRole) error {
+	stored := make(map[string]string, len(entries))
+
+	for mask, role := range entries {
+		stored[mask] = role.String()
+	}
+
+	value, err := json.Marshal(stored)
+
+	if err != nil {
+		return err
+	}
+
+	return saveSetting(channel, aclSetting, string(value))
+}
+
+// aclRoleOf возвращает роль пользователя на канале.
+func aclRoleOf(channel string, caller aclCaller) aclRole {
+	config := currentConfig()
+
+	if aclIsOwner(caller) {
+		return roleOwner
+	}
+
+	role := roleNone
+
+	for mask, entryRole := range aclEntries(channel) {
+		if entryRole > role && privateMaskMatch(mask, caller.Source, caller.Account) {
+			role = entryRole
+		}
+	}
+
+	if role < roleAdmin && aclOpsAreAdmins(config) && chanState.IsOped(channel, caller.Nick) {
+		role = roleAdmin
+	}
+
+	return role
+}
+
+// aclOpsAreAdmins проверяет, считаются ли операторы канала его админами. Если в конфиге это не задано (например, конфиг
+// ещё не прочитан), то считаются.
+func aclOpsAreAdmins(config *myConfig) bool {
+	return config.Irc.Admin.OpsAreAdmins == nil || *config.Irc.Admin.OpsAreAdmins
+}
+
+// aclIsOwner проверяет, является ли пользователь владельцем бота.
+func aclIsOwner(caller aclCaller) bool {
+	config := currentConfig()
+
+	return slices.ContainsFunc(config.Irc.Admin.Owners, func(mask string) bool {
+		return privateMaskMatch(mask, caller.Source, caller.Account)
+	})
+}
+
+// aclMask превращает аргумент команды в маску для acl: маски nick!user@host и $a:account берутся как есть, а для ника
+// участника канала берётся его services account или, если он не залогинен, маска *!user@host.
+func aclMask(target string) (string, bool) {
+	if strings.HasPrefix(target, "$a:") || strings.Contains(target, "!") {
+		return target, true
+	}
+
+	user, ok := chanState.User(target)
+
+	switch {
+	case !ok:
+		return "", false
+	case user.Account != "":
+		return "$a:" + user.Account, true
+	case user.User != "" && user.Host != "":
+		return "*!" + user.User + "@" + user.Host, true
+	default:
+		return "", false
+	}
+}
+
+// aclCommand выполняет команды trust и untrust из !admin и возвращает ответ для пользователя.
+func aclCommand(channel string, caller aclCaller, role aclRole, command string, args []string) string {
+	if role < roleAdmin {
+		return "Управлять доверенными участниками могут только админы канала"
+	}
+
+	if len(args) == 0 {
+		return "Кого?"
+	}
+
+	mask, ok := aclMask(args[0])
+
+	if !ok {
+		return "Не знаю участника с ником " + args[0] + ", укажите маску nick!user@host или $a:account"
+	}
+
+	entries := aclEntries(channel)
+
+	switch command {
+	case "trust":
+		newRole := roleTrusted
+
+		if len(args) > 1 {
+			if newRole, ok = parseACLRole(args[1]); !ok {
+				return "Роль может быть trusted или admin"
+			}
+		}
+
+		// Админов назначает и разжалует только владелец
+		if (newRole == roleAdmin || entries[mask] == roleAdmin) && role < roleOwner {
+			return "Назначать и снимать админов может только владелец бота"
+		}
+
+		entries[mask] = newRole
+	case "untrust":
+		current, found := entries[mask]
+
+		switch {
+		case !found:
+			return mask + " и так нет в списке доверенных"
+		case current == roleAdmin && role < roleOwner:
+			return "Снимать админов может только владелец бота"
+		case role < roleOwner && privateMaskMatch(mask, caller.Source, caller.Account):
+			return "Себя из списка доверенных удалить нельзя"
+		}
+
+		delete(entries, mask)
+	}
+
+	if err := aclSave(channel, entries); err != nil {
+		log.Errorf("Unable to save acl of %s: %s", channel, err)
+
+		return "Не удалось сохранить список доверенных"
+	}
+
+	if command == "untrust" {
+		log.Infof("%s removed %s from acl of %s", caller.Source, mask, channel)
+
+		return mask + " удалён из списка доверенных"
+	}
+
+	log.Infof("%s added %s to acl of %s as %s", caller.Source, mask, channel, entries[mask])
+
+	return mask + " теперь " + entries[mask].String()
+}
+
+// aclList возвращает acl канала для вывода пользователю, по строчке на маску.
+func aclList(channel string) []string {
+	config := currentConfig()
+
+	var lines []string
+
+	for _, owner := range config.Irc.Admin.Owners {
+		lines = append(lines, owner+": "+roleOwner.String())
+	}
+
+	entries := aclEntries(channel)
+	masks := make([]string, 0, len(entries))
+
+	for mask := range entries {
+		masks = append(masks, mask)
+	}
+
+	slices.Sort(masks)
+
+	for _, mask := range masks {
+		lines = append(lines, mask+": "+entries[mask].String())
+	}
+
+	if aclOpsAreAdmins(config) {
+		lines = append(lines, "операторы канала: "+roleAdmin.String())
+	}
+
+	return lines
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminInPrivate(t *testing.T) {
+	withMemoryBus(t)
+
+	config := *currentConfig()
+	config.Irc.Private.Enabled = true
+	config.Irc.Private.RateLimit.Messages = 10
+	config.Irc.Private.RateLimit.Period = 60
+	config.Irc.Private.DailyQuota = 100
+	config.DataDir = t.TempDir()
+	setConfig(config)
+
+	// С account-tag отправитель опознаётся сразу, без WHOIS
+	ackedCaps.Set("account-tag", true)
+	t.Cleanup(func() {
+		ackedCaps.Delete("account-tag")
+	})
+
+	databases := len(settingsDB)
+
+	ircMsgParser("aleesa", "alice", "alice", "alice!alice@host.tld", "!admin", nil, msgKindPrivmsg)
+
+	got := queued()
+
+	if len(got) != 1 || got[0].ChatID != "alice" || !strings.Contains(got[0].Text, "только на канале") {
+		t.Errorf("queued %+v for !admin in private, want refusal", got)
+	}
+
+	ircMsgParser("aleesa", "alice", "alice", "alice!alice@host.tld", "!help", nil, msgKindPrivmsg)
+
+	for _, m := range queued() {
+		if strings.Contains(m.Text, "!admin") {
+			t.Errorf("!help in private offers %q", m.Text)
+		}
+	}
+
+	// Настройки заводятся только для каналов, а не для собеседников в привате
+	if len(settingsDB) != databases {
+		t.Error("settings db opened for private query")
+	}
+}
+
+func TestCommandsSkipWhois(t *testing.T) {
+	withMemoryBus(t)
+	identities.Reset()
+	t.Cleanup(identities.Reset)
+
+	ircMsgParser("#chan", "alice", "alice", "alice!alice@host.tld", "!ping", nil, msgKindPrivmsg)
+
+	// Обычным командам права не нужны, так что и спрашивать WHOIS про отправителя незачем
+	if m, ok, _ := sender.pop(time.Now()); ok {
+		t.Errorf("sent %q for !ping", m.Text)
+	}
+
+	ircMsgParser("#chan", "alice", "alice", "alice!alice@host.tld", "!admin", nil, msgKindPrivmsg)
+
+	if m, ok, _ := sender.pop(time.Now()); !ok || m.Text != "WHOIS alice" {
+		t.Errorf("sent %q for !admin, want WHOIS alice", m.Text)
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"aleesa-irc-go/internal/boolcollection"
+
+	log "github.com/sirupsen/logrus"
+	irc "github.com/thoj/go-ircevent"
+)
+
+/* IRCv3 capabilities, см. https://ircv3.net/specs/extensions/capability-negotiation .
+ * go-ircevent сам умеет в CAP только для sasl, причём без поддержки многострочного ответа CAP LS 302, поэтому
+ * все остальные capabilities мы запрашиваем сами, уже после регистрации на сервере (то есть после 001 RPL_WELCOME).
+ * Спецификация это разрешает, а сервер в этом случае просто не задерживает регистрацию клиента.
+ */
+
+// Список capabilities, которые мы запрашиваем у сервера, если он их анонсирует.
+var wantedCaps = []string{
+	"message-tags",
+	"server-time",
+	"account-tag",
+	"extended-join",
+	"account-notify",
+	"multi-prefix",
+	"away-notify",
+	"chghost",
+}
+
+// "Базюлька" с capabilities, которые сервер подтвердил (ACK).
+var ackedCaps = boolcollection.NewCollection()
+
+// Накопитель для многострочного ответа CAP LS 302.
+var capLs struct {
+	sync.Mutex
+	inProgress bool
+	caps       []string
+}
+
+// capNegotiate начинает согласование capabilities с сервером.
+func capNegotiate(connection *irc.Connection) {
+	// Коллекцию читают из других горутин, поэтому чистим её на месте, а не подменяем
+	ackedCaps.Clear()
+
+	capLs.Lock()
+	capLs.inProgress = true
+	capLs.caps = nil
+	capLs.Unlock()
+
+	log.Debug("Requesting list of server capabilities")
+	connection.SendRaw("CAP LS 302")
+}
+
+// capIsAcked сообщает, подтвердил ли сервер запрошенную capability.
+func capIsAcked(capName string) bool {
+	acked, _ := ackedCaps.Get(capName)
+
+	return acked
+}
+
+// capCallback обрабатывает ответы сервера на CAP-запросы.
+func capCallback(e *irc.Event) {
+	// Формат: CAP <nick> <subcommand> [*] :<caps>
+	if len(e.Arguments) < 3 {
+		return
+	}
+
+	subcommand := strings.ToUpper(e.Arguments[1])
+	capsString := e.Arguments[len(e.Arguments)-1]
+	// Звёздочка перед списком означает, что это не последняя строка многострочного ответа.
+	moreToCome := len(e.Arguments) > 3 && e.Arguments[2] == "*"
+
+	switch subcommand {
+	case "LS":
+		capLs.Lock()
+
+		if !capLs.inProgress {
+			// Это ответ на CAP LS, который отправил сам go-ircevent при согласовании sasl, он нам не интересен.
+			capLs.Unlock()
+
+			return
+		}
+
+		capLs.caps = append(capLs.caps, capNames(capsString)...)
+
+		if moreToCome {
+			capLs.Unlock()
+
+			return
+		}
+
+		offered := capLs.caps
+		capLs.inProgress = false
+		capLs.caps = nil
+		capLs.Unlock()
+
+		log.Debugf("Server offers capabilities: %s", strings.Join(offered, " "))
+		capRequest(e.Connection, offered)
+
+	case "NEW":
+		// cap-notify неявно включается при CAP LS 302, сервер сообщает о новых capabilities.
+		capRequest(e.Connection, capNames(capsString))
+
+	case "ACK":
+		for _, capName := range strings.Fields(capsString) {
+			if strings.HasPrefix(capName, "-") {
+				ackedCaps.Delete(capName[1:])
+				log.Infof("Capability %s disabled", capName[1:])
+
+				continue
+			}
+
+			ackedCaps.Set(capName, true)
+			log.Infof("Capability %s enabled", capName)
+		}
+
+	case "NAK":
+		caps := strings.Fields(capsString)
+		log.Warnf("Server refused capabilities: %s", strings.Join(caps, " "))
+
+		// Запрос атомарен: если сервер отказал в наборе целиком, попробуем запросить capabilities по одной.
+		if len(caps) > 1 {
+			for _, capName := range caps {
+				e.Connection.SendRawf("CAP REQ :%s", capName)
+			}
+		}
+
+	case "DEL":
+		for _, capName := range capNames(capsString) {
+			ackedCaps.Delete(capName)
+			log.Infof("Server withdrew capability %s", capName)
+		}
+	}
+}
+
+// capRequest запрашивает у сервера интересные нам capabilities из числа предложенных.
+func capRequest(connection *irc.Connection, offered []string) {
+	var request []string
+
+	for _, capName := range wantedCaps {
+		if slices.Contains(offered, capName) && !capIsAcked(capName) {
+			request = append(request, capName)
+		}
+	}
+
+	if len(request) == 0 {
+		log.Debug("None of wanted capabilities are offered by server")
+
+		return
+	}
+
+	log.Debugf("Requesting capabilities: %s", strings.Join(request, " "))
+	connection.SendRawf("CAP REQ :%s", strings.Join(request, " "))
+}
+
+// capNames вынимает имена capabilities из строки вида "cap1 cap2=value cap3".
+func capNames(capsString string) []string {
+	var names []string
+
+	for _, token := range strings.Fields(capsString) {
+		name, _, _ := strings.Cut(token, "=")
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// tagAccount возвращает services account отправителя из тэга account-tag, если он есть.
+func tagAccount(tags map[string]string) string {
+	account := tags["account"]
+
+	// "*" означает, что пользователь не залогинен в services.
+	if account == "*" {
+		return ""
+	}
+
+	return account
+}
+
+// tagServerTime возвращает время сообщения из тэга server-time, либо текущее время, если тэга нет.
+func tagServerTime(tags map[string]string) time.Time {
+	if value, ok := tags["time"]; ok {
+		if serverTime, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return serverTime
+		}
+
+		log.Debugf("Unable to parse server-time tag %s", value)
+	}
+
+	return time.Now().UTC()
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
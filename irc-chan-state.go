@@ -0,0 +1,581 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Состояние каналов, на которых сидит бот: кто там есть и с какими префиксными MODE-ами. Нужно оно для того, чтобы:
+- Определять, может ли пользователь воспользоваться командой admin
+- Применять ли ограничения на исходящие сообщения. MODE-ы +v и +o для бота на libera.chat активируют мягкий ratelimit на
+  стороне сервера, без них, сервер просто рвёт соединение по превышению лимитов
+- Проверять, что адресат команды (например, бармэна) действительно находится на канале
+
+Поддерживается оно событиями JOIN/PART/KICK/QUIT/NICK/MODE, ответами на NAMES (353/366) и WHO (352/354), а также
+IRCv3-событиями AWAY, CHGHOST и ACCOUNT, если сервер согласился их присылать.
+*/
+
+// ircUser - это сведения о пользователе, общие для всех каналов, на которых он есть.
+type ircUser struct {
+	Nick    string
+	User    string
+	Host    string
+	Account string
+	// Известно ли, залогинен ли пользователь в services: пустой Account может означать и "не залогинен", и "не знаем".
+	AccountKnown bool
+	Away         bool
+}
+
+// Hostmask возвращает полное имя пользователя в виде nick!user@host, если user и host нам известны.
+func (user ircUser) Hostmask() string {
+	if user.User == "" || user.Host == "" {
+		return user.Nick
+	}
+
+	return user.Nick + "!" + user.User + "@" + user.Host
+}
+
+// channelMember - это участник канала.
+type channelMember struct {
+	ircUser
+	// Буквы префиксных MODE-ов участника на канале, например "ov".
+	Modes    string
+	JoinTime time.Time
+}
+
+// channelModes - это MODE-ы самого канала.
+type channelModes struct {
+	// Списки масок для MODE-ов типа A из CHANMODES, например, b, e и I.
+	Lists map[byte][]string
+	// Ключ канала, +k.
+	Key string
+	// Ограничение на количество участников, +l, 0 - если его нет.
+	Limit int
+	// Значения прочих MODE-ов с параметром (типы B и C из CHANMODES).
+	Params map[byte]string
+	// MODE-ы без параметров (тип D из CHANMODES), например, t - топик может менять только оператор.
+	Flags string
+}
+
+// channelState - это состояние одного канала.
+type channelState struct {
+	Name string
+	// Мы получили 366 RPL_ENDOFNAMES, то есть список участников полон.
+	Synced  bool
+	modes   channelModes
+	members map[string]*channelMember
+}
+
+// chanStateTracker хранит состояние всех каналов, на которых есть бот. Ключи в мапках приведены к каноническому виду
+// согласно CASEMAPPING.
+type chanStateTracker struct {
+	sync.RWMutex
+	channels map[string]*channelState
+	users    map[string]*ircUser
+}
+
+// newChanStateTracker создаёт пустой трекер состояния каналов.
+func newChanStateTracker() *chanStateTracker {
+	return &chanStateTracker{
+		channels: make(map[string]*channelState),
+		users:    make(map[string]*ircUser),
+	}
+}
+
+// Reset забывает всё, что мы знали о каналах, например, при переподключении к серверу.
+func (tracker *chanStateTracker) Reset() {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	tracker.channels = make(map[string]*channelState)
+	tracker.users = make(map[string]*ircUser)
+}
+
+// user возвращает запись о пользователе, создавая её, если надо. Вызывается под блокировкой.
+func (tracker *chanStateTracker) user(nick string) *ircUser {
+	key := isupport.Casefold(nick)
+	user, ok := tracker.users[key]
+
+	if !ok {
+		user = &ircUser{Nick: nick}
+		tracker.users[key] = user
+	}
+
+	return user
+}
+
+// addMember добавляет пользователя на канал, если его там ещё нет. Вызывается под блокировкой.
+func (tracker *chanStateTracker) addMember(channel *channelState, nick string) *channelMember {
+	key := isupport.Casefold(nick)
+	member, ok := channel.members[key]
+
+	if !ok {
+		member = &channelMember{JoinTime: time.Now()}
+		channel.members[key] = member
+	}
+
+	member.ircUser = *tracker.user(nick)
+
+	return member
+}
+
+// gcUser забывает пользователя, если он больше не виден ни на одном канале. Вызывается под блокировкой.
+func (tracker *chanStateTracker) gcUser(nick string) {
+	key := isupport.Casefold(nick)
+
+	for _, channel := range tracker.channels {
+		if _, ok := channel.members[key]; ok {
+			return
+		}
+	}
+
+	delete(tracker.users, key)
+}
+
+// syncUser раскладывает обновлённые сведения о пользователе по всем каналам, где он есть. Вызывается под блокировкой.
+func (tracker *chanStateTracker) syncUser(user *ircUser) {
+	key := isupport.Casefold(user.Nick)
+
+	for _, channel := range tracker.channels {
+		if member, ok := channel.members[key]; ok {
+			member.ircUser = *user
+		}
+	}
+}
+
+// SelfJoin заводит состояние для канала, на который зашёл бот.
+func (tracker *chanStateTracker) SelfJoin(channelName string) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	tracker.channels[isupport.Casefold(channelName)] = &channelState{
+		Name: channelName,
+		modes: channelModes{
+			Lists:  make(map[byte][]string),
+			Params: make(map[byte]string),
+		},
+		members: make(map[string]*channelMember),
+	}
+}
+
+// SelfLeave забывает состояние канала, с которого бот ушёл или был кикнут.
+func (tracker *chanStateTracker) SelfLeave(channelName string) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	channel, ok := tracker.channels[isupport.Casefold(channelName)]
+
+	if !ok {
+		return
+	}
+
+	delete(tracker.channels, isupport.Casefold(channelName))
+
+	for _, member := range channel.members {
+		tracker.gcUser(member.Nick)
+	}
+}
+
+// Join добавляет пользователя на канал. Account может быть пустым, если он неизвестен (нет extended-join).
+func (tracker *chanStateTracker) Join(channelName string, nick string, userName string, host string, account string) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	channel, ok := tracker.channels[isupport.Casefold(channelName)]
+
+	if !ok {
+		return
+	}
+
+	user := tracker.user(nick)
+	user.User = userName
+	user.Host = host
+
+	if account != "" {
+		user.Account = account
+		user.AccountKnown = true
+	}
+
+	tracker.addMember(channel, nick)
+	tracker.syncUser(user)
+}
+
+// Leave удаляет пользователя с канала (PART или KICK).
+func (tracker *chanStateTracker) Leave(channelName string, nick string) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	channel, ok := tracker.channels[isupport.Casefold(channelName)]
+
+	if !ok {
+		return
+	}
+
+	delete(channel.members, isupport.Casefold(nick))
+	tracker.gcUser(nick)
+}
+
+// Quit удаляет пользователя со всех каналов.
+func (tracker *chanStateTracker) Quit(nick string) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	key := isupport.Casefold(nick)
+
+	for _, channel := range tracker.channels {
+		delete(channel.members, key)
+	}
+
+	delete(tracker.users, key)
+}
+
+// Rename атомарно переименовывает пользователя на всех каналах, сохраняя его MODE-ы и прочие сведения.
+func (tracker *chanStateTracker) Rename(oldNick string, newNick string) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	oldKey := isupport.Casefold(oldNick)
+	newKey := isupport.Casefold(newNick)
+
+	user, ok := tracker.users[oldKey]
+
+	if !ok {
+		return
+	}
+
+	delete(tracker.users, oldKey)
+	user.Nick = newNick
+	tracker.users[newKey] = user
+
+	for _, channel := range tracker.channels {
+		if member, ok := channel.members[oldKey]; ok {
+			delete(channel.members, oldKey)
+			member.ircUser = *user
+			channel.members[newKey] = member
+		}
+	}
+}
+
+// SetPrefixes выставляет участнику канала набор префиксных MODE-ов целиком, как в ответах NAMES, WHO и WHOIS. Если
+// пользователя на канале ещё нет, он туда добавляется.
+func (tracker *chanStateTracker) SetPrefixes(channelName string, nick string, modes string) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	channel, ok := tracker.channels[isupport.Casefold(channelName)]
+
+	if !ok {
+		return
+	}
+
+	tracker.addMember(channel, nick).Modes = modes
+}
+
+// ApplyModes применяет к каналу разобранную строку MODE: префиксные MODE-ы раздаются участникам, остальные меняют
+// MODE-ы самого канала.
+func (tracker *chanStateTracker) ApplyModes(channelName string, changes []modeChange) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	channel, ok := tracker.channels[isupport.Casefold(channelName)]
+
+	if !ok {
+		return
+	}
+
+	for _, change := range changes {
+		switch change.Type {
+		case 'P':
+			if member, ok := channel.members[isupport.Casefold(change.Param)]; ok {
+				member.Modes = modeToggle(member.Modes, change.Mode, change.Set)
+			}
+		case 'A':
+			list := slices.DeleteFunc(channel.modes.Lists[change.Mode], func(mask string) bool {
+				return isupport.Equal(mask, change.Param)
+			})
+
+			if change.Set {
+				list = append(list, change.Param)
+			}
+
+			channel.modes.Lists[change.Mode] = list
+		case 'B', 'C':
+			if change.Set {
+				channel.modes.Params[change.Mode] = change.Param
+			} else {
+				delete(channel.modes.Params, change.Mode)
+			}
+
+			switch change.Mode {
+			case 'k':
+				channel.modes.Key = channel.modes.Params['k']
+			case 'l':
+				channel.modes.Limit = isupportInt(channel.modes.Params['l'], 0)
+			}
+		default:
+			channel.modes.Flags = modeToggle(channel.modes.Flags, change.Mode, change.Set)
+		}
+	}
+}
+
+// ChannelModes возвращает копию MODE-ов канала.
+func (tracker *chanStateTracker) ChannelModes(channelName string) (channelModes, bool) {
+	tracker.RLock()
+	defer tracker.RUnlock()
+
+	channel, ok := tracker.channels[isupport.Casefold(channelName)]
+
+	if !ok {
+		return channelModes{}, false
+	}
+
+	modes := channel.modes
+	modes.Lists = make(map[byte][]string, len(channel.modes.Lists))
+	modes.Params = make(map[byte]string, len(channel.modes.Params))
+
+	for mode, list := range channel.modes.Lists {
+		modes.Lists[mode] = slices.Clone(list)
+	}
+
+	for mode, param := range channel.modes.Params {
+		modes.Params[mode] = param
+	}
+
+	return modes, true
+}
+
+// HasFlag сообщает, установлен ли на канале MODE без параметра, например, t или m.
+func (tracker *chanStateTracker) HasFlag(channelName string, mode byte) bool {
+	modes, ok := tracker.ChannelModes(channelName)
+
+	return ok && strings.IndexByte(modes.Flags, mode) >= 0
+}
+
+// SetSynced отмечает, что список участников канала получен полностью.
+func (tracker *chanStateTracker) SetSynced(channelName string) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	if channel, ok := tracker.channels[isupport.Casefold(channelName)]; ok {
+		channel.Synced = true
+	}
+}
+
+// UpdateUser обновляет user и host пользователя, пустые значения не трогает.
+func (tracker *chanStateTracker) UpdateUser(nick string, userName string, host string) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	user, ok := tracker.users[isupport.Casefold(nick)]
+
+	if !ok {
+		return
+	}
+
+	if userName != "" {
+		user.User = userName
+	}
+
+	if host != "" {
+		user.Host = host
+	}
+
+	tracker.syncUser(user)
+}
+
+// SetAccount запоминает services account пользователя, пустая строка означает, что он не залогинен.
+func (tracker *chanStateTracker) SetAccount(nick string, account string) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	user, ok := tracker.users[isupport.Casefold(nick)]
+
+	if !ok {
+		return
+	}
+
+	user.Account = account
+	user.AccountKnown = true
+	tracker.syncUser(user)
+}
+
+// SetAway запоминает, отошёл ли пользователь.
+func (tracker *chanStateTracker) SetAway(nick string, away bool) {
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	user, ok := tracker.users[isupport.Casefold(nick)]
+
+	if !ok {
+		return
+	}
+
+	user.Away = away
+	tracker.syncUser(user)
+}
+
+// IsHere сообщает, есть ли ник на канале.
+func (tracker *chanStateTracker) IsHere(channelName string, nick string) bool {
+	_, ok := tracker.Member(channelName, nick)
+
+	return ok
+}
+
+// HasMode сообщает, есть ли у участника канала указанный префиксный MODE.
+func (tracker *chanStateTracker) HasMode(channelName string, nick string, mode byte) bool {
+	member, ok := tracker.Member(channelName, nick)
+
+	return ok && strings.IndexByte(member.Modes, mode) >= 0
+}
+
+// IsOped сообщает, есть ли у участника канала MODE o или более привилегированный, например, q или a.
+func (tracker *chanStateTracker) IsOped(channelName string, nick string) bool {
+	member, ok := tracker.Member(channelName, nick)
+
+	if !ok {
+		return false
+	}
+
+	for _, mode := range []byte(member.Modes) {
+		if isupport.ModeAtLeast(mode, 'o') {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsVoiced сообщает, есть ли у участника канала MODE v.
+func (tracker *chanStateTracker) IsVoiced(channelName string, nick string) bool {
+	return tracker.HasMode(channelName, nick, 'v')
+}
+
+// Member возвращает копию сведений об участнике канала.
+func (tracker *chanStateTracker) Member(channelName string, nick string) (channelMember, bool) {
+	tracker.RLock()
+	defer tracker.RUnlock()
+
+	channel, ok := tracker.channels[isupport.Casefold(channelName)]
+
+	if !ok {
+		return channelMember{}, false
+	}
+
+	member, ok := channel.members[isupport.Casefold(nick)]
+
+	if !ok {
+		return channelMember{}, false
+	}
+
+	return *member, true
+}
+
+// Members возвращает копию списка участников канала.
+func (tracker *chanStateTracker) Members(channelName string) []channelMember {
+	tracker.RLock()
+	defer tracker.RUnlock()
+
+	channel, ok := tracker.channels[isupport.Casefold(channelName)]
+
+	if !ok {
+		return nil
+	}
+
+	members := make([]channelMember, 0, len(channel.members))
+
+	for _, member := range channel.members {
+		members = append(members, *member)
+	}
+
+	slices.SortFunc(members, func(a, b channelMember) int {
+		return strings.Compare(a.Nick, b.Nick)
+	})
+
+	return members
+}
+
+// User возвращает копию сведений о пользователе, если он есть хотя бы на одном из наших каналов.
+func (tracker *chanStateTracker) User(nick string) (ircUser, bool) {
+	tracker.RLock()
+	defer tracker.RUnlock()
+
+	user, ok := tracker.users[isupport.Casefold(nick)]
+
+	if !ok {
+		return ircUser{}, false
+	}
+
+	return *user, true
+}
+
+// Channels возвращает имена каналов, на которых есть бот.
+func (tracker *chanStateTracker) Channels() []string {
+	tracker.RLock()
+	defer tracker.RUnlock()
+
+	channels := make([]string, 0, len(tracker.channels))
+
+	for _, channel := range tracker.channels {
+		channels = append(channels, channel.Name)
+	}
+
+	slices.Sort(channels)
+
+	return channels
+}
+
+// IsSynced сообщает, получен ли полный список участников канала.
+func (tracker *chanStateTracker) IsSynced(channelName string) bool {
+	tracker.RLock()
+	defer tracker.RUnlock()
+
+	channel, ok := tracker.channels[isupport.Casefold(channelName)]
+
+	return ok && channel.Synced
+}
+
+// modeToggle добавляет MODE в строку с MODE-ами или убирает его оттуда.
+func modeToggle(modes string, mode byte, set bool) string {
+	hasMode := strings.IndexByte(modes, mode) >= 0
+
+	switch {
+	case set && !hasMode:
+		return modes + string(mode)
+	case !set && hasMode:
+		return strings.ReplaceAll(modes, string(mode), "")
+	}
+
+	return modes
+}
+
+// Токен, которым мы помечаем свои WHOX-запросы, чтобы отличать ответы на них от чужих.
+const whoxToken = "152"
+
+// chanStateWho запрашивает сведения об участниках канала: через WHOX, если сервер его умеет, либо через обычный WHO.
+func chanStateWho(channel string) {
+	if _, ok := isupport.Token("WHOX"); ok {
+		ircClient.SendRawf("WHO %s %%tcuhnfa,%s", channel, whoxToken)
+
+		return
+	}
+
+	ircClient.Who(channel)
+}
+
+// chanStateWhoReply обновляет состояние канала по строке ответа на WHO или WHOX.
+func chanStateWhoReply(channel string, nick string, userName string, host string, flags string, account string) {
+	// flags - это H (here) или G (gone), затем опционально * (ircop), затем префиксы участника канала, например, G*@+.
+	if flags == "" {
+		return
+	}
+
+	_, modes := isupport.StripPrefixes(strings.TrimPrefix(flags[1:], "*"))
+
+	chanState.SetPrefixes(channel, nick, modes)
+	chanState.UpdateUser(nick, userName, host)
+	chanState.SetAway(nick, flags[0] == 'G')
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+/* Настройки каналов из конфига. Исторически канал в конфиге задавался строкой "#channel key", такая форма по-прежнему
+ * понимается, но теперь канал может быть и объектом:
+ *   { "name": "#channel", "key": "secret", "autojoin": true, "csign": ".", "plugins": [ "w", "karma" ] }
+ */
+
+// UnmarshalJSON разбирает настройки канала как из объекта, так и из строки старого формата "#channel key".
+func (channel *channelConfig) UnmarshalJSON(data []byte) error {
+	var line string
+
+	if err := json.Unmarshal(data, &line); err == nil {
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 || len(fields) > 2 {
+			return fmt.Errorf("incorrect channel definition: %q", line)
+		}
+
+		*channel = channelConfig{Name: fields[0], Autojoin: true}
+
+		if len(fields) == 2 {
+			channel.Key = fields[1]
+		}
+
+		return nil
+	}
+
+	// Отдельный тип, чтобы json.Unmarshal не зациклился на этом же методе.
+	type plainChannelConfig channelConfig
+
+	plain := plainChannelConfig{Autojoin: true}
+
+	if err := json.Unmarshal(data, &plain); err != nil {
+		return err
+	}
+
+	if plain.Name == "" {
+		return fmt.Errorf("channel definition has no name: %s", string(data))
+	}
+
+	*channel = channelConfig(plain)
+
+	return nil
+}
+
+// channelSettings ищет настройки канала name в конфиге.
+func channelSettings(name string) (channelConfig, bool) {
+	config := currentConfig()
+
+	i := slices.IndexFunc(config.Irc.Channels, func(channel channelConfig) bool {
+		return isupport.Equal(channel.Name, name)
+	})
+
+	if i < 0 {
+		return channelConfig{}, false
+	}
+
+	return config.Irc.Channels[i], true
+}
+
+// channelConfigured проверяет, должен ли бот находиться на канале name согласно конфигу.
+func channelConfigured(name string) bool {
+	_, ok := channelSettings(name)
+
+	return ok
+}
+
+// channelCsign возвращает символ-префикс команд для канала name.
+func channelCsign(name string) string {
+	config := currentConfig()
+
+	if settings, ok := channelSettings(name); ok && settings.Csign != "" {
+		return settings.Csign
+	}
+
+	return config.Csign
+}
+
+// channelDelay возвращает минимальную задержку между сообщениями в канал name, 0 - если её нет.
+func channelDelay(name string) time.Duration {
+	settings, _ := channelSettings(name)
+
+	return time.Duration(settings.RateLimit.SimpleDelay) * time.Millisecond
+}
+
+// channelPluginEnabled проверяет, пересылается ли команда spec на канале name в router. В списке plugins канала
+// команду можно указать как по имени, так и по любому из синонимов, и это разрешает её целиком, как её ни назови.
+func channelPluginEnabled(name string, spec commandSpec) bool {
+	settings, ok := channelSettings(name)
+
+	if !ok || len(settings.Plugins) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(spec.Names(), func(command string) bool {
+		return slices.Contains(settings.Plugins, command)
+	})
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	irc "github.com/thoj/go-ircevent"
+)
+
+/* Ответы на CTCP-запросы, см. https://modern.ircdocs.horse/ctcp .
+ * go-ircevent из коробки отвечает на VERSION, TIME, PING, USERINFO и CLIENTINFO сам и мимо ratelimit-а, поэтому его
+ * обработчики мы заменяем своими: ответы идут через планировщик исходящих сообщений, а их содержимое задаётся в
+ * конфиге. Сам go-ircevent раскладывает CTCP-запросы по событиям CTCP_VERSION, CTCP_TIME и т.д., а всё, что он не знает
+ * (например, SOURCE) - в событие CTCP. ACTION обрабатывается вместе с PRIVMSG, см. aleesa-irc-go-lib.go.
+ */
+
+// Версия, которую бот сообщает в ответ на CTCP VERSION, если в конфиге не задано иное.
+const defaultCtcpVersion = "aleesa-irc-go"
+
+// CTCP-запросы, на которые бот в принципе умеет отвечать.
+var ctcpCommands = []string{"CLIENTINFO", "PING", "SOURCE", "TIME", "USERINFO", "VERSION"}
+
+// ctcpSetup заменяет обработчики CTCP-запросов go-ircevent-а на наши.
+func ctcpSetup(connection *irc.Connection) {
+	// SOURCE go-ircevent не знает, такие запросы прилетают в событие CTCP
+	known := slices.DeleteFunc(slices.Clone(ctcpCommands), func(command string) bool {
+		return command == "SOURCE"
+	})
+
+	for _, command := range known {
+		connection.ClearCallback("CTCP_" + command)
+		connection.AddCallback("CTCP_"+command, ctcpCallback)
+	}
+
+	connection.AddCallback("CTCP", ctcpCallback)
+}
+
+// ctcpCallback отвечает на CTCP-запрос, если ответ на него не выключен в конфиге.
+func ctcpCallback(e *irc.Event) {
+	if shuttingDown() || isMe(e.Nick) {
+		return
+	}
+
+	command, params, _ := strings.Cut(e.Message(), " ")
+	command = strings.ToUpper(command)
+
+	reply, ok := ctcpReply(command, params)
+
+	if !ok {
+		log.Debugf("Ignoring CTCP %s from %s", command, e.Source)
+
+		return
+	}
+
+	log.Debugf("Answering CTCP %s from %s", command, e.Source)
+	sender.Enqueue(iMsg{ChatID: e.Nick, Text: reply, Kind: msgKindCtcpReply})
+}
+
+// ctcpReply возвращает ответ на CTCP-запрос command с параметрами params, false - если отвечать на него не надо.
+func ctcpReply(command string, params string) (string, bool) {
+	config := currentConfig()
+
+	if !ctcpEnabled(command) {
+		return "", false
+	}
+
+	switch command {
+	case "CLIENTINFO":
+		// ACTION бот понимает всегда, хоть и не отвечает на него.
+		supported := []string{"ACTION"}
+
+		for _, c := range ctcpCommands {
+			if ctcpEnabled(c) && (c != "SOURCE" || config.Irc.Ctcp.Source != "") {
+				supported = append(supported, c)
+			}
+		}
+
+		return "CLIENTINFO " + strings.Join(supported, " "), true
+	case "PING":
+		// Параметр PING-а надо вернуть как есть, по нему клиент считает задержку.
+		return strings.TrimSpace("PING " + params), true
+	case "SOURCE":
+		if config.Irc.Ctcp.Source == "" {
+			return "", false
+		}
+
+		return "SOURCE " + config.Irc.Ctcp.Source, true
+	case "TIME":
+		return "TIME " + time.Now().Format(time.RFC1123Z), true
+	case "USERINFO":
+		return "USERINFO " + config.Irc.Ctcp.Userinfo, true
+	case "VERSION":
+		return "VERSION " + config.Irc.Ctcp.Version, true
+	}
+
+	return "", false
+}
+
+// ctcpEnabled проверяет, знает ли бот CTCP-запрос command и не выключен ли ответ на него в конфиге.
+func ctcpEnabled(command string) bool {
+	config := currentConfig()
+
+	if !slices.Contains(ctcpCommands, command) {
+		return false
+	}
+
+	return !slices.ContainsFunc(config.Irc.Ctcp.Disabled, func(disabled string) bool {
+		return strings.EqualFold(disabled, command)
+	})
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Опознание тех, кто присылает команды !admin. Ник сам по себе ничего не значит: его может занять кто угодно, стоит
+ * прежнему владельцу выйти или сменить ник. Поэтому права проверяются по полному источнику сообщения nick!user@host,
+ * который присылает сервер, и по services account. Account берётся, в порядке предпочтения:
+ *   - из тэга account-tag, если сервер его поддерживает: он приходит с каждым сообщением и всегда актуален;
+ *   - из состояния каналов (см. irc-chan-state.go), если сервер поддерживает account-notify и сообщает о каждом
+ *     логине и разлогине, а account стал известен из extended-join, WHOX или WHOIS;
+ *   - из недавнего ответа на WHOIS (330 RPL_WHOISACCOUNT), если с тех пор у пользователя не сменился источник.
+ *
+ * Если ничего из этого нет, или состояние каналов помнит под этим ником другой nick!user@host, то мы отправляем WHOIS,
+ * а команду отвергаем с объяснением в NOTICE: повторить её можно будет, когда придёт ответ.
+ */
+
+const (
+	// Сколько верим ответу на WHOIS.
+	identityTTL = 5 * time.Minute
+	// Не чаще, чем раз в столько, спрашиваем WHOIS про один и тот же ник, если ответа так и нет.
+	identityWhoisRetry = 30 * time.Second
+)
+
+// whoisIdentity - это то, что мы узнали о пользователе из ответа на WHOIS.
+type whoisIdentity struct {
+	Source  string
+	Account string
+	At      time.Time
+	// Пришёл ли 311 RPL_WHOISUSER, без него пользователя в сети нет.
+	found bool
+}
+
+// identityResolver опознаёт отправителей команд и помнит ответы на WHOIS.
+type identityResolver struct {
+	sync.Mutex
+	// Полученные ответы на WHOIS.
+	known map[string]whoisIdentity
+	// Ответы на WHOIS, которые ещё приходят, до 318 RPL_ENDOFWHOIS.
+	partial map[string]*whoisIdentity
+	// Когда мы последний раз спрашивали WHOIS про ник.
+	asked map[string]time.Time
+}
+
+// newIdentityResolver создаёт пустой identityResolver.
+func newIdentityResolver() *identityResolver {
+	return &identityResolver{
+		known:   make(map[string]whoisIdentity),
+		partial: make(map[string]*whoisIdentity),
+		asked:   make(map[string]time.Time),
+	}
+}
+
+// Resolve опознаёт отправителя сообщения по нику, источнику nick!user@host и тэгам сообщения. Если account отправителя
+// пока неизвестен, то отправляется WHOIS, а Resolve возвращает false.
+func (resolver *identityResolver) Resolve(nick string, source string, tags map[string]string, now time.Time) (aclCaller, bool) {
+	caller := aclCaller{Nick: nick, Source: source}
+	user, tracked := chanState.User(nick)
+
+	// Под этим ником мы помним кого-то другого, значит, и его account, и MODE-ы могли устареть
+	if tracked && user.User != "" && !strings.EqualFold(user.Hostmask(), source) {
+		resolver.request(nick, now)
+
+		return caller, false
+	}
+
+	if capIsAcked("account-tag") {
+		caller.Account = tagAccount(tags)
+
+		return caller, true
+	}
+
+	if tracked && user.AccountKnown && capIsAcked("account-notify") {
+		caller.Account = user.Account
+
+		return caller, true
+	}
+
+	resolver.Lock()
+	identity, ok := resolver.known[isupport.Casefold(nick)]
+	resolver.Unlock()
+
+	if ok && now.Sub(identity.At) < identityTTL && strings.EqualFold(identity.Source, source) {
+		caller.Account = identity.Account
+
+		return caller, true
+	}
+
+	resolver.request(nick, now)
+
+	return caller, false
+}
+
+// request отправляет WHOIS про ник, если мы не спрашивали про него совсем недавно.
+func (resolver *identityResolver) request(nick string, now time.Time) {
+	key := isupport.Casefold(nick)
+
+	resolver.Lock()
+
+	if asked, ok := resolver.asked[key]; ok && now.Sub(asked) < identityWhoisRetry {
+		resolver.Unlock()
+
+		return
+	}
+
+	resolver.asked[key] = now
+	resolver.Unlock()
+
+	sender.EnqueuePriority(iMsg{ChatID: nick, Text: "WHOIS " + nick, Kind: msgKindRaw})
+}
+
+// pending возвращает недособранный ответ на WHOIS про ник, создавая его, если надо. Вызывается под блокировкой.
+func (resolver *identityResolver) pending(nick string) *whoisIdentity {
+	key := isupport.Casefold(nick)
+	identity, ok := resolver.partial[key]
+
+	if !ok {
+		identity = &whoisIdentity{}
+		resolver.partial[key] = identity
+	}
+
+	return identity
+}
+
+// WhoisUser запоминает user и host из 311 RPL_WHOISUSER.
+func (resolver *identityResolver) WhoisUser(nick string, userName string, host string) {
+	resolver.Lock()
+	defer resolver.Unlock()
+
+	identity := resolver.pending(nick)
+	identity.Source = nick + "!" + userName + "@" + host
+	identity.found = true
+}
+
+// WhoisAccount запоминает account из 330 RPL_WHOISACCOUNT.
+func (resolver *identityResolver) WhoisAccount(nick string, account string) {
+	resolver.Lock()
+	defer resolver.Unlock()
+
+	resolver.pending(nick).Account = account
+}
+
+// WhoisEnd завершает ответ на WHOIS по 318 RPL_ENDOFWHOIS и обновляет по нему состояние каналов. Если 330 так и не
+// пришёл, значит, пользователь не залогинен в services.
+func (resolver *identityResolver) WhoisEnd(nick string, now time.Time) {
+	key := isupport.Casefold(nick)
+
+	resolver.Lock()
+
+	identity, ok := resolver.partial[key]
+	delete(resolver.partial, key)
+	delete(resolver.asked, key)
+
+	if !ok || !identity.found {
+		// Такого ника в сети нет, а на каналах мы его помним зря
+		delete(resolver.known, key)
+		resolver.Unlock()
+		chanState.Quit(nick)
+
+		return
+	}
+
+	identity.At = now
+	resolver.known[key] = *identity
+	resolver.Unlock()
+
+	_, userHost, _ := strings.Cut(identity.Source, "!")
+	userName, host, _ := strings.Cut(userHost, "@")
+
+	chanState.UpdateUser(nick, userName, host)
+	chanState.SetAccount(nick, identity.Account)
+}
+
+// Reset забывает все ответы на WHOIS, например, при переподключении к серверу.
+func (resolver *identityResolver) Reset() {
+	resolver.Lock()
+	defer resolver.Unlock()
+
+	resolver.known = make(map[string]whoisIdentity)
+	resolver.partial = make(map[string]*whoisIdentity)
+	resolver.asked = make(map[string]time.Time)
+}
+
+// Forget забывает всё, что узнали о нике из WHOIS. Вызывается, когда ник сменил владельца или владелец сменил account.
+func (resolver *identityResolver) Forget(nick string) {
+	key := isupport.Casefold(nick)
+
+	resolver.Lock()
+	defer resolver.Unlock()
+
+	delete(resolver.known, key)
+	delete(resolver.asked, key)
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
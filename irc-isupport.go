@@ -0,0 +1,389 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+	irc "github.com/thoj/go-ircevent"
+)
+
+/* Реестр возможностей сервера, которые он анонсирует в 005 RPL_ISUPPORT, см.
+ * https://defs.ircdocs.horse/defs/isupport и https://modern.ircdocs.horse/#rplisupport-parameters .
+ * Пока сервер ничего не прислал, действуют значения по-умолчанию из RFC 1459/2812.
+ */
+
+// Значения по-умолчанию, если сервер не прислал соответствующий токен.
+const (
+	defaultPrefix      = "(ov)@+"
+	defaultChanTypes   = "#&"
+	defaultChanModes   = "beI,k,l,imnpst"
+	defaultCaseMapping = "rfc1459"
+	defaultNickLen     = 9
+	defaultLineLen     = 512
+)
+
+// serverFeatures - это типизированное представление токенов из 005 RPL_ISUPPORT.
+type serverFeatures struct {
+	sync.RWMutex
+	// Все токены как есть, значение пустое, если у токена его нет.
+	tokens map[string]string
+	// Буквы MODE-ов, дающих префикс нику, в порядке убывания привилегий, например "qaohv".
+	prefixModes string
+	// Соответствующие им символы префиксов, например "~&@%+".
+	prefixSymbols string
+	// Символы, с которых начинаются имена каналов.
+	chanTypes string
+	// Типы A, B, C и D channel MODE-ов из CHANMODES.
+	chanModes   [4]string
+	caseMapping string
+	nickLen     int
+	topicLen    int
+	lineLen     int
+	// Максимальное количество целей для команды, 0 - без ограничения.
+	targMax map[string]int
+}
+
+// newServerFeatures создаёт реестр, заполненный значениями по-умолчанию.
+func newServerFeatures() *serverFeatures {
+	features := &serverFeatures{}
+	features.setDefaults()
+
+	return features
+}
+
+// Reset забывает всё, что анонсировал сервер, и возвращает значения по-умолчанию. Реестр не подменяется целиком,
+// потому что его в это время читают из других горутин.
+func (features *serverFeatures) Reset() {
+	features.Lock()
+	defer features.Unlock()
+
+	features.setDefaults()
+}
+
+// setDefaults заполняет реестр значениями по-умолчанию. Вызывается под блокировкой или до того, как реестр стал
+// доступен другим горутинам.
+func (features *serverFeatures) setDefaults() {
+	features.tokens = make(map[string]string)
+	features.targMax = make(map[string]int)
+	features.topicLen = 0
+
+	features.setPrefix(defaultPrefix)
+	features.setChanModes(defaultChanModes)
+	features.chanTypes = defaultChanTypes
+	features.caseMapping = defaultCaseMapping
+	features.nickLen = defaultNickLen
+	features.lineLen = defaultLineLen
+}
+
+// isupportCallback обрабатывает очередную строку 005 RPL_ISUPPORT.
+func isupportCallback(e *irc.Event) {
+	// Формат: 005 <nick> <token> [<token> ...] :are supported by this server
+	if len(e.Arguments) < 3 {
+		return
+	}
+
+	isupport.Update(e.Arguments[1 : len(e.Arguments)-1])
+}
+
+// Update применяет к реестру токены из строки 005 RPL_ISUPPORT.
+func (features *serverFeatures) Update(tokens []string) {
+	features.Lock()
+	defer features.Unlock()
+
+	for _, token := range tokens {
+		// "-TOKEN" означает, что сервер больше не поддерживает этот параметр, вернём значение по-умолчанию.
+		if strings.HasPrefix(token, "-") {
+			name := token[1:]
+			delete(features.tokens, name)
+			features.reset(name)
+
+			continue
+		}
+
+		name, value, _ := strings.Cut(token, "=")
+		value = isupportUnescape(value)
+		features.tokens[name] = value
+
+		log.Debugf("Server supports %s=%s", name, value)
+
+		switch name {
+		case "PREFIX":
+			features.setPrefix(value)
+		case "CHANTYPES":
+			features.chanTypes = value
+		case "CHANMODES":
+			features.setChanModes(value)
+		case "CASEMAPPING":
+			features.caseMapping = strings.ToLower(value)
+		case "NICKLEN":
+			features.nickLen = isupportInt(value, defaultNickLen)
+		case "TOPICLEN":
+			features.topicLen = isupportInt(value, 0)
+		case "LINELEN":
+			features.lineLen = isupportInt(value, defaultLineLen)
+		case "TARGMAX":
+			features.targMax = make(map[string]int)
+
+			for _, target := range strings.Split(value, ",") {
+				command, limit, _ := strings.Cut(target, ":")
+				features.targMax[strings.ToUpper(command)] = isupportInt(limit, 0)
+			}
+		}
+	}
+}
+
+// reset возвращает значение по-умолчанию для параметра, который сервер отозвал.
+func (features *serverFeatures) reset(name string) {
+	switch name {
+	case "PREFIX":
+		features.setPrefix(defaultPrefix)
+	case "CHANTYPES":
+		features.chanTypes = defaultChanTypes
+	case "CHANMODES":
+		features.setChanModes(defaultChanModes)
+	case "CASEMAPPING":
+		features.caseMapping = defaultCaseMapping
+	case "NICKLEN":
+		features.nickLen = defaultNickLen
+	case "TOPICLEN":
+		features.topicLen = 0
+	case "LINELEN":
+		features.lineLen = defaultLineLen
+	case "TARGMAX":
+		features.targMax = make(map[string]int)
+	}
+}
+
+// setPrefix разбирает значение вида "(ov)@+".
+func (features *serverFeatures) setPrefix(value string) {
+	modes, symbols, ok := strings.Cut(strings.TrimPrefix(value, "("), ")")
+
+	// PREFIX= без значения означает, что префиксов нет вовсе.
+	if !ok || len(modes) != len(symbols) {
+		modes, symbols = "", ""
+	}
+
+	features.prefixModes = modes
+	features.prefixSymbols = symbols
+}
+
+// setChanModes разбирает значение вида "beI,k,l,imnpst".
+func (features *serverFeatures) setChanModes(value string) {
+	features.chanModes = [4]string{}
+
+	for i, modes := range strings.SplitN(value, ",", 4) {
+		features.chanModes[i] = modes
+	}
+}
+
+// Token возвращает значение произвольного токена и признак того, что сервер его анонсировал.
+func (features *serverFeatures) Token(name string) (string, bool) {
+	features.RLock()
+	defer features.RUnlock()
+
+	value, ok := features.tokens[name]
+
+	return value, ok
+}
+
+// StripPrefixes отделяет префиксы вида @+ от ника или канала и возвращает MODE-ы, которые им соответствуют.
+func (features *serverFeatures) StripPrefixes(name string) (string, string) {
+	features.RLock()
+	defer features.RUnlock()
+
+	var modes strings.Builder
+
+	for name != "" {
+		i := strings.IndexByte(features.prefixSymbols, name[0])
+
+		if i < 0 {
+			break
+		}
+
+		modes.WriteByte(features.prefixModes[i])
+		name = name[1:]
+	}
+
+	return name, modes.String()
+}
+
+// PrefixModes возвращает буквы MODE-ов, дающих префикс нику, в порядке убывания привилегий.
+func (features *serverFeatures) PrefixModes() string {
+	features.RLock()
+	defer features.RUnlock()
+
+	return features.prefixModes
+}
+
+// IsPrefixMode сообщает, даёт ли MODE нику префикс (то есть это o, v, h и им подобные).
+func (features *serverFeatures) IsPrefixMode(mode byte) bool {
+	features.RLock()
+	defer features.RUnlock()
+
+	return strings.IndexByte(features.prefixModes, mode) >= 0
+}
+
+// ModeAtLeast сообщает, что MODE mode даёт не меньше привилегий, чем MODE base, например, q или a не меньше, чем o.
+func (features *serverFeatures) ModeAtLeast(mode byte, base byte) bool {
+	features.RLock()
+	defer features.RUnlock()
+
+	modeRank := strings.IndexByte(features.prefixModes, mode)
+	baseRank := strings.IndexByte(features.prefixModes, base)
+
+	if modeRank < 0 {
+		return false
+	}
+
+	// Если сервер не знает про base вовсе, то сравнивать не с чем, считаем, что привилегий достаточно только у самого
+	// base.
+	if baseRank < 0 {
+		return mode == base
+	}
+
+	return modeRank <= baseRank
+}
+
+// ChanModeType возвращает тип channel MODE-а из CHANMODES: 'A' - списки (b, e, I), 'B' - всегда с параметром (k),
+// 'C' - с параметром только при установке (l), 'D' - без параметра, 'P' - префиксные MODE-ы (o, v) и 0, если сервер
+// про такой MODE не знает.
+func (features *serverFeatures) ChanModeType(mode byte) byte {
+	features.RLock()
+	defer features.RUnlock()
+
+	if strings.IndexByte(features.prefixModes, mode) >= 0 {
+		return 'P'
+	}
+
+	for i, modes := range features.chanModes {
+		if strings.IndexByte(modes, mode) >= 0 {
+			return byte('A' + i)
+		}
+	}
+
+	return 0
+}
+
+// IsChannel сообщает, является ли цель каналом, а не ником.
+func (features *serverFeatures) IsChannel(target string) bool {
+	features.RLock()
+	defer features.RUnlock()
+
+	return target != "" && strings.IndexByte(features.chanTypes, target[0]) >= 0
+}
+
+// Casefold приводит ник или имя канала к каноническому виду согласно CASEMAPPING.
+func (features *serverFeatures) Casefold(name string) string {
+	features.RLock()
+	caseMapping := features.caseMapping
+	features.RUnlock()
+
+	var upper string
+
+	switch caseMapping {
+	case "ascii":
+		upper = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	case "rfc1459-strict", "strict-rfc1459":
+		upper = "ABCDEFGHIJKLMNOPQRSTUVWXYZ[]\\"
+	case "rfc1459":
+		upper = "ABCDEFGHIJKLMNOPQRSTUVWXYZ[]\\~"
+	default:
+		// rfc7613 и всё неизвестное приводим к нижнему регистру целиком, включая non-ascii.
+		return strings.ToLower(name)
+	}
+
+	lower := "abcdefghijklmnopqrstuvwxyz{}|^"
+
+	return strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf {
+			if i := strings.IndexRune(upper, r); i >= 0 {
+				return rune(lower[i])
+			}
+		}
+
+		return r
+	}, name)
+}
+
+// Equal сравнивает два ника или два имени канала с учётом CASEMAPPING.
+func (features *serverFeatures) Equal(a string, b string) bool {
+	return features.Casefold(a) == features.Casefold(b)
+}
+
+// NickLen возвращает максимальную длину ника.
+func (features *serverFeatures) NickLen() int {
+	features.RLock()
+	defer features.RUnlock()
+
+	return features.nickLen
+}
+
+// TopicLen возвращает максимальную длину топика, 0 - если сервер про неё не сообщил.
+func (features *serverFeatures) TopicLen() int {
+	features.RLock()
+	defer features.RUnlock()
+
+	return features.topicLen
+}
+
+// LineLen возвращает максимальную длину строки протокола в байтах, включая \r\n.
+func (features *serverFeatures) LineLen() int {
+	features.RLock()
+	defer features.RUnlock()
+
+	return features.lineLen
+}
+
+// TargMax возвращает максимальное количество целей для команды, 0 - если ограничения нет.
+func (features *serverFeatures) TargMax(command string) int {
+	features.RLock()
+	defer features.RUnlock()
+
+	return features.targMax[strings.ToUpper(command)]
+}
+
+// isMe сообщает, является ли ник нашим собственным текущим ником.
+func isMe(nick string) bool {
+	return isupport.Equal(nick, ircClient.GetNick())
+}
+
+// isupportInt разбирает числовое значение токена, возвращая fallback, если значения нет или оно кривое.
+func isupportInt(value string, fallback int) int {
+	number, err := strconv.Atoi(value)
+
+	if err != nil || number < 0 {
+		return fallback
+	}
+
+	return number
+}
+
+// isupportUnescape раскрывает escape-последовательности вида \x20 в значениях токенов.
+func isupportUnescape(value string) string {
+	if !strings.Contains(value, `\x`) {
+		return value
+	}
+
+	var result strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) && value[i+1] == 'x' {
+			if b, err := strconv.ParseUint(value[i+2:i+4], 16, 8); err == nil {
+				result.WriteByte(byte(b))
+
+				i += 3
+
+				continue
+			}
+		}
+
+		result.WriteByte(value[i])
+	}
+
+	return result.String()
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
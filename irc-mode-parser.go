@@ -0,0 +1,103 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+/* Разбор строк MODE, см. https://modern.ircdocs.horse/#mode-message .
+ * Одна строка может менять сразу несколько MODE-ов, а параметры к ним идут следом в том же порядке, например:
+ *   MODE #chan +ov-v alice bob carol
+ *   MODE #chan +bk *!*@spam.tld secret
+ *   MODE #chan -l+t
+ * Какой MODE потребляет параметр, а какой нет, определяется по типу из CHANMODES и PREFIX в 005 RPL_ISUPPORT.
+ */
+
+// modeChange - это одно изменение MODE-а из строки MODE.
+type modeChange struct {
+	// true - MODE устанавливается, false - снимается.
+	Set  bool
+	Mode byte
+	// Тип MODE-а, см. serverFeatures.ChanModeType(), для user MODE-ов всегда 'D'.
+	Type byte
+	// Параметр MODE-а, пустой, если MODE параметра не имеет.
+	Param string
+}
+
+// parseChanModes разбирает строку изменения channel MODE-ов, раздавая параметры тем MODE-ам, которым они положены.
+func parseChanModes(modes string, params []string) []modeChange {
+	var changes []modeChange
+
+	set := true
+
+	for i := 0; i < len(modes); i++ {
+		mode := modes[i]
+
+		switch mode {
+		case '+':
+			set = true
+
+			continue
+		case '-':
+			set = false
+
+			continue
+		}
+
+		change := modeChange{Set: set, Mode: mode, Type: isupport.ChanModeType(mode)}
+
+		var needParam bool
+
+		switch change.Type {
+		case 'A', 'B', 'P':
+			// Списки, ключ канала и префиксные MODE-ы параметр имеют всегда.
+			needParam = true
+		case 'C':
+			// Например, лимит участников: параметр есть только при установке.
+			needParam = set
+		case 'D':
+			needParam = false
+		default:
+			// Сервер про такой MODE ничего не анонсировал, предполагаем, что параметра у него нет, иначе все
+			// последующие параметры поедут.
+			log.Debugf("Unknown channel mode %c in %s, assuming it has no parameter", mode, modes)
+		}
+
+		if needParam {
+			if len(params) == 0 {
+				// Для списков без параметра это запрос самого списка (MODE #chan b), это не изменение.
+				log.Debugf("Channel mode %c in %s has no parameter, skipping", mode, modes)
+
+				continue
+			}
+
+			change.Param = params[0]
+			params = params[1:]
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+// parseUserModes разбирает строку изменения user MODE-ов, у них параметров не бывает.
+func parseUserModes(modes string) []modeChange {
+	var changes []modeChange
+
+	set := true
+
+	for i := 0; i < len(modes); i++ {
+		switch modes[i] {
+		case '+':
+			set = true
+		case '-':
+			set = false
+		default:
+			changes = append(changes, modeChange{Set: set, Mode: modes[i], Type: 'D'})
+		}
+	}
+
+	return changes
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
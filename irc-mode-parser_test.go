@@ -0,0 +1,238 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+/* Тесты разбора строк MODE и 324 RPL_CHANNELMODEIS. Строки взяты из живых серверов, токены 005 RPL_ISUPPORT - оттуда
+ * же: solanum (libera.chat) и UnrealIRCd.
+ */
+
+// Токены 005 RPL_ISUPPORT серверов, на строках которых построены тесты.
+var (
+	isupportSolanum = []string{"CHANTYPES=#", "CHANMODES=eIbq,k,flj,CFLMPQRSTcgimnprstuz", "PREFIX=(ov)@+"}
+	isupportUnreal  = []string{"CHANTYPES=#", "CHANMODES=beI,fkL,lFH,cdimnprstzCDGKMNOPQRSTVZ", "PREFIX=(qaohv)~&@%+"}
+)
+
+// withISupport заполняет isupport токенами сервера на время теста.
+func withISupport(t *testing.T, tokens []string) {
+	t.Helper()
+
+	isupport.Reset()
+	isupport.Update(tokens)
+	t.Cleanup(isupport.Reset)
+}
+
+func TestParseChanModes(t *testing.T) {
+	tests := []struct {
+		name     string
+		isupport []string
+		modes    string
+		params   []string
+		want     []modeChange
+	}{
+		{
+			name:     "prefix modes on both signs",
+			isupport: isupportSolanum,
+			modes:    "+ov-v",
+			params:   []string{"alice", "bob", "carol"},
+			want: []modeChange{
+				{Set: true, Mode: 'o', Type: 'P', Param: "alice"},
+				{Set: true, Mode: 'v', Type: 'P', Param: "bob"},
+				{Set: false, Mode: 'v', Type: 'P', Param: "carol"},
+			},
+		},
+		{
+			name:     "list mode and key",
+			isupport: isupportSolanum,
+			modes:    "+bk",
+			params:   []string{"*!*@spam.tld", "secret"},
+			want: []modeChange{
+				{Set: true, Mode: 'b', Type: 'A', Param: "*!*@spam.tld"},
+				{Set: true, Mode: 'k', Type: 'B', Param: "secret"},
+			},
+		},
+		{
+			name:     "limit set",
+			isupport: isupportSolanum,
+			modes:    "+l",
+			params:   []string{"10"},
+			want:     []modeChange{{Set: true, Mode: 'l', Type: 'C', Param: "10"}},
+		},
+		{
+			// Параметр после -l принадлежит следующему MODE-у, а не лимиту
+			name:     "limit unset takes no parameter",
+			isupport: isupportSolanum,
+			modes:    "-l+b",
+			params:   []string{"*!*@spam.tld"},
+			want: []modeChange{
+				{Set: false, Mode: 'l', Type: 'C'},
+				{Set: true, Mode: 'b', Type: 'A', Param: "*!*@spam.tld"},
+			},
+		},
+		{
+			// Solanum присылает * вместо настоящего ключа при его снятии
+			name:     "key unset with star",
+			isupport: isupportSolanum,
+			modes:    "-k",
+			params:   []string{"*"},
+			want:     []modeChange{{Set: false, Mode: 'k', Type: 'B', Param: "*"}},
+		},
+		{
+			name:     "list modes on both signs",
+			isupport: isupportSolanum,
+			modes:    "-b+qe",
+			params:   []string{"*!*@old.tld", "$a:troll", "*!*@friend.tld"},
+			want: []modeChange{
+				{Set: false, Mode: 'b', Type: 'A', Param: "*!*@old.tld"},
+				{Set: true, Mode: 'q', Type: 'A', Param: "$a:troll"},
+				{Set: true, Mode: 'e', Type: 'A', Param: "*!*@friend.tld"},
+			},
+		},
+		{
+			name:     "type D flags",
+			isupport: isupportSolanum,
+			modes:    "+nt-s",
+			want: []modeChange{
+				{Set: true, Mode: 'n', Type: 'D'},
+				{Set: true, Mode: 't', Type: 'D'},
+				{Set: false, Mode: 's', Type: 'D'},
+			},
+		},
+		{
+			// Неизвестный MODE параметр не забирает, иначе поедут все последующие
+			name:     "unknown letter",
+			isupport: isupportSolanum,
+			modes:    "+Xo",
+			params:   []string{"alice"},
+			want: []modeChange{
+				{Set: true, Mode: 'X'},
+				{Set: true, Mode: 'o', Type: 'P', Param: "alice"},
+			},
+		},
+		{
+			// MODE #chan b - это запрос банлиста, а не изменение
+			name:     "list query without parameter",
+			isupport: isupportSolanum,
+			modes:    "+b",
+		},
+		{
+			name:     "missing parameters",
+			isupport: isupportSolanum,
+			modes:    "+kol",
+			params:   []string{"secret"},
+			want:     []modeChange{{Set: true, Mode: 'k', Type: 'B', Param: "secret"}},
+		},
+		{
+			// 324 RPL_CHANNELMODEIS от solanum: :irc 324 aleesa #chan +Cnlkt 25 secret
+			name:     "RPL_CHANNELMODEIS",
+			isupport: isupportSolanum,
+			modes:    "+Cnlkt",
+			params:   []string{"25", "secret"},
+			want: []modeChange{
+				{Set: true, Mode: 'C', Type: 'D'},
+				{Set: true, Mode: 'n', Type: 'D'},
+				{Set: true, Mode: 'l', Type: 'C', Param: "25"},
+				{Set: true, Mode: 'k', Type: 'B', Param: "secret"},
+				{Set: true, Mode: 't', Type: 'D'},
+			},
+		},
+		{
+			// У UnrealIRCd L - это тип B, а f - тоже, так что оба берут параметр и при снятии
+			name:     "unreal prefixes and type B modes",
+			isupport: isupportUnreal,
+			modes:    "+qh-L+f",
+			params:   []string{"owner", "helper", "#overflow", "[5j#R1]:3"},
+			want: []modeChange{
+				{Set: true, Mode: 'q', Type: 'P', Param: "owner"},
+				{Set: true, Mode: 'h', Type: 'P', Param: "helper"},
+				{Set: false, Mode: 'L', Type: 'B', Param: "#overflow"},
+				{Set: true, Mode: 'f', Type: 'B', Param: "[5j#R1]:3"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withISupport(t, test.isupport)
+
+			got := parseChanModes(test.modes, test.params)
+
+			if !slices.Equal(got, test.want) {
+				t.Errorf("parseChanModes(%q, %q) = %+v, want %+v", test.modes, test.params, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseUserModes(t *testing.T) {
+	tests := []struct {
+		modes string
+		want  []modeChange
+	}{
+		// :aleesa MODE aleesa :+Ziw
+		{"+Ziw", []modeChange{{Set: true, Mode: 'Z', Type: 'D'}, {Set: true, Mode: 'i', Type: 'D'}, {Set: true, Mode: 'w', Type: 'D'}}},
+		// :NickServ!NickServ@services.libera.chat MODE aleesa :-R+x
+		{"-R+x", []modeChange{{Set: false, Mode: 'R', Type: 'D'}, {Set: true, Mode: 'x', Type: 'D'}}},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		if got := parseUserModes(test.modes); !slices.Equal(got, test.want) {
+			t.Errorf("parseUserModes(%q) = %+v, want %+v", test.modes, got, test.want)
+		}
+	}
+}
+
+func TestApplyModes(t *testing.T) {
+	withISupport(t, isupportSolanum)
+
+	tracker := newChanStateTracker()
+	tracker.SelfJoin("#chan")
+
+	for _, nick := range []string{"alice", "bob", "carol"} {
+		tracker.Join("#chan", nick, nick, "host.tld", "")
+	}
+
+	tracker.SetPrefixes("#chan", "carol", "v")
+
+	// Последовательность строк, как она приходит от сервера после JOIN-а: сначала 324, потом изменения
+	lines := []struct {
+		modes  string
+		params []string
+	}{
+		{"+Cnlkt", []string{"25", "secret"}},
+		{"+ov-v", []string{"alice", "bob", "carol"}},
+		{"+bb", []string{"*!*@spam.tld", "*!*@flood.tld"}},
+		{"-b", []string{"*!*@SPAM.tld"}},
+		{"-k+l", []string{"*", "10"}},
+		{"-C", nil},
+	}
+
+	for _, line := range lines {
+		tracker.ApplyModes("#chan", parseChanModes(line.modes, line.params))
+	}
+
+	modes, ok := tracker.ChannelModes("#chan")
+
+	if !ok {
+		t.Fatal("channel state lost")
+	}
+
+	if modes.Key != "" || modes.Limit != 10 || modes.Flags != "nt" {
+		t.Errorf("key %q, limit %d, flags %q, want no key, limit 10 and flags nt", modes.Key, modes.Limit, modes.Flags)
+	}
+
+	if bans := modes.Lists['b']; !slices.Equal(bans, []string{"*!*@flood.tld"}) {
+		t.Errorf("bans %q, want only *!*@flood.tld", bans)
+	}
+
+	for nick, want := range map[string]string{"alice": "o", "bob": "v", "carol": ""} {
+		if member, _ := tracker.Member("#chan", nick); member.Modes != want {
+			t.Errorf("%s has modes %q, want %q", nick, member.Modes, want)
+		}
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	irc "github.com/thoj/go-ircevent"
+)
+
+/* Обработка входящих NOTICE-ов. Их присылают:
+ *   - сам сервер, например, "*** Looking up your hostname" при подключении, у них нет nick!user@host в источнике;
+ *   - сервисы сети (NickServ, ChanServ и т.д.), например, ответы на identify;
+ *   - клиенты в ответ на наши CTCP-запросы;
+ *   - обычные участники каналов.
+ * В router пересылаются только последние, остальные нужны лишь для логов.
+ */
+
+// Ники сервисов, если в конфиге не задано иное.
+var defaultServices = []string{"NickServ", "ChanServ", "MemoServ", "OperServ", "HostServ", "BotServ", "SaslServ"}
+
+// noticeCallback разбирает входящий NOTICE и отправляет его в подходящий обработчик.
+func noticeCallback(e *irc.Event) {
+	if len(e.Arguments) < 2 {
+		return
+	}
+
+	target := e.Arguments[0]
+	text := e.Message()
+
+	switch {
+	case !strings.Contains(e.Source, "!"):
+		log.Infof("Server notice from %s: %s", e.Source, text)
+	case isService(e.Nick):
+		servicesNotice(e.Nick, text)
+	case strings.HasPrefix(text, "\x01"):
+		log.Debugf("CTCP reply from %s: %s", e.Source, strings.Trim(text, "\x01"))
+	default:
+		log.Debugf("Incoming NOTICE: %s", e.Raw)
+		ircMsgParser(target, e.Nick, e.User, e.Source, text, e.Tags, msgKindNotice)
+	}
+}
+
+// isService проверяет, является ли nick одним из сервисов сети.
+func isService(nick string) bool {
+	config := currentConfig()
+
+	return slices.ContainsFunc(config.Irc.Services, func(service string) bool {
+		return isupport.Equal(service, nick)
+	})
+}
+
+// servicesNotice обрабатывает NOTICE от сервисов сети. На них бот не отвечает, но неудачную авторизацию стоит заметить
+// в логах.
+func servicesNotice(service string, text string) {
+	lowerText := strings.ToLower(text)
+
+	for _, failure := range []string{"invalid password", "password incorrect", "incorrect password", "access denied"} {
+		if strings.Contains(lowerText, failure) {
+			log.Warnf("%s: %s", service, text)
+
+			return
+		}
+	}
+
+	log.Infof("%s: %s", service, text)
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
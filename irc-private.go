@@ -0,0 +1,186 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* Приватные сообщения (query). По-умолчанию бот в привате не отвечает, чтобы не было возможности DDoS-а: ratelimit-ы в
+ * irc жёсткие и общие на всё соединение, так что один пользователь в привате может заставить ждать все каналы. Поэтому
+ * приват включается в конфиге явно, доступ к нему ограничивается списками масок, а каждому пользователю положен свой
+ * ratelimit и дневная квота.
+ *
+ * Элемент списков allow и deny - это либо маска вида nick!user@host с * и ?, либо $a:account, что означает
+ * пользователя, залогиненного в services под этим account-ом.
+ */
+
+// privateUsage - это учёт сообщений в привате от одного пользователя.
+type privateUsage struct {
+	// Время последних сообщений, не старше периода ratelimit-а.
+	recent []time.Time
+	// Сколько сообщений принято за день.
+	count int
+	// Пользователю уже сказали, что он упёрся в ограничение, повторять это не надо.
+	warned bool
+}
+
+// privateLimiter считает сообщения в привате по пользователям.
+type privateLimiter struct {
+	sync.Mutex
+	usage map[string]*privateUsage
+	// День, за который ведётся учёт, в формате 2006-01-02.
+	day string
+}
+
+// newPrivateLimiter создаёт пустой учёт приватных сообщений.
+func newPrivateLimiter() *privateLimiter {
+	return &privateLimiter{usage: make(map[string]*privateUsage)}
+}
+
+// Allow учитывает очередное сообщение от пользователя key. Возвращает true, если сообщение можно обработать, и true
+// вторым значением, если сообщение отклонено впервые с момента последнего принятого.
+func (limiter *privateLimiter) Allow(key string, now time.Time) (bool, bool) {
+	config := currentConfig()
+
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	// Наступил новый день, учёт пользователей, которые писали вчера, больше не нужен.
+	if today := now.Format(time.DateOnly); limiter.day != today {
+		limiter.day = today
+		limiter.usage = make(map[string]*privateUsage)
+	}
+
+	usage, ok := limiter.usage[key]
+
+	if !ok {
+		usage = &privateUsage{}
+		limiter.usage[key] = usage
+	}
+
+	period := time.Duration(config.Irc.Private.RateLimit.Period) * time.Second
+
+	for len(usage.recent) > 0 && now.Sub(usage.recent[0]) >= period {
+		usage.recent = usage.recent[1:]
+	}
+
+	if len(usage.recent) >= config.Irc.Private.RateLimit.Messages || usage.count >= config.Irc.Private.DailyQuota {
+		firstRejection := !usage.warned
+		usage.warned = true
+
+		return false, firstRejection
+	}
+
+	usage.recent = append(usage.recent, now)
+	usage.count++
+	usage.warned = false
+
+	return true, false
+}
+
+// privateAccept решает, будет ли бот обрабатывать приватное сообщение от nick с маской source.
+func privateAccept(nick string, source string, account string) bool {
+	config := currentConfig()
+
+	if !config.Irc.Private.Enabled {
+		// В привате бот не отвечает, чтобы не было возможности DDoS-а, ratelimit-ы в irc слишком жёсткие
+		return false
+	}
+
+	if account == "" {
+		if user, ok := chanState.User(nick); ok {
+			account = user.Account
+		}
+	}
+
+	for _, mask := range config.Irc.Private.Deny {
+		if privateMaskMatch(mask, source, account) {
+			log.Debugf("Private message from %s is denied by mask %s", source, mask)
+
+			return false
+		}
+	}
+
+	if len(config.Irc.Private.Allow) > 0 {
+		allowed := false
+
+		for _, mask := range config.Irc.Private.Allow {
+			if privateMaskMatch(mask, source, account) {
+				allowed = true
+
+				break
+			}
+		}
+
+		if !allowed {
+			log.Debugf("Private message from %s is not allowed by any mask", source)
+
+			return false
+		}
+	}
+
+	// Ограничения считаем на account, если он есть, иначе на user@host: ник сменить куда проще.
+	key := "$a:" + isupport.Casefold(account)
+
+	if account == "" {
+		_, key, _ = strings.Cut(source, "!")
+		key = strings.ToLower(key)
+	}
+
+	ok, firstRejection := privateUsers.Allow(key, time.Now())
+
+	if !ok {
+		log.Infof("Private message from %s is rate limited", source)
+
+		if firstRejection {
+			sender.Enqueue(iMsg{ChatID: nick, Text: "Слишком много запросов, попробуйте позже", Kind: msgKindNotice})
+		}
+	}
+
+	return ok
+}
+
+// privateMaskMatch проверяет, подходит ли пользователь с маской source и account-ом account под маску mask из конфига.
+func privateMaskMatch(mask string, source string, account string) bool {
+	if name, ok := strings.CutPrefix(mask, "$a:"); ok {
+		return account != "" && isupport.Equal(name, account)
+	}
+
+	return wildcardMatch(isupport.Casefold(mask), isupport.Casefold(source))
+}
+
+// wildcardMatch сравнивает строку с маской, в которой * - это любое количество любых символов, а ? - ровно один
+// символ. path.Match для ников не годится: [ и ] в них - обычные символы.
+func wildcardMatch(mask string, s string) bool {
+	// Позиции последней * в маске и символа строки, с которого она начала совпадать.
+	star, from := -1, 0
+	m, i := 0, 0
+
+	for i < len(s) {
+		switch {
+		case m < len(mask) && (mask[m] == '?' || mask[m] == s[i]):
+			m++
+			i++
+		case m < len(mask) && mask[m] == '*':
+			star, from = m, i
+			m++
+		case star >= 0:
+			// Пусть последняя * съест ещё один символ.
+			from++
+			m, i = star+1, from
+		default:
+			return false
+		}
+	}
+
+	for m < len(mask) && mask[m] == '*' {
+		m++
+	}
+
+	return m == len(mask)
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* Планировщик исходящих сообщений. Для каждой цели (канала или ника) держится своя очередь, а отправка идёт по кругу
+ * между целями, так что один болтливый канал не может заставить ждать все остальные. Поверх этого действует общий для
+ * всего соединения ограничитель скорости, потому что сервер считает наши сообщения на соединение целиком, а не на
+ * отдельный канал.
+ *
+ * Служебные сообщения (авторизация у NickServ, JOIN-ы) идут вне очереди по отдельной полосе. PONG-и в планировщик не
+ * попадают вовсе, go-ircevent отвечает на PING сам и немедленно.
+ */
+
+// Максимальная длина очереди сообщений для одной цели, если в конфиге не задано иное.
+const defaultQueueDepth = 50
+
+// Сколько секунд при выключении ждать отправки сообщений, оставшихся в очереди, если в конфиге не задано иное.
+const defaultDrainTimeout = 5
+
+// sendScheduler раздаёт исходящие сообщения из очередей по целям в порядке round-robin.
+type sendScheduler struct {
+	sync.Mutex
+	// Служебные сообщения, отправляются раньше всех прочих.
+	priority []iMsg
+	// Очереди обычных сообщений, ключ - цель, приведённая к каноническому виду согласно CASEMAPPING.
+	queues map[string][]iMsg
+	// Цели, у которых есть неотправленные сообщения, в порядке очерёдности.
+	order []string
+	// Время, раньше которого в цель нельзя отправлять, для каналов с собственной задержкой в конфиге.
+	notBefore map[string]time.Time
+	// Сюда прилетает уведомление о том, что в очередях что-то появилось.
+	wake chan struct{}
+	// Сообщения, которые уже достали из очереди, но ещё не отправили.
+	inflight int
+}
+
+// newSendScheduler создаёт пустой планировщик.
+func newSendScheduler() *sendScheduler {
+	return &sendScheduler{
+		queues:    make(map[string][]iMsg),
+		notBefore: make(map[string]time.Time),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Enqueue ставит сообщение в очередь его цели. Если очередь переполнена, самое старое сообщение в ней выбрасывается.
+func (scheduler *sendScheduler) Enqueue(m iMsg) {
+	config := currentConfig()
+
+	scheduler.Lock()
+
+	key := isupport.Casefold(m.ChatID)
+	queue, ok := scheduler.queues[key]
+
+	if !ok || len(queue) == 0 {
+		scheduler.order = append(scheduler.order, key)
+	}
+
+	depth := config.Irc.RateLimit.QueueDepth
+
+	if depth <= 0 {
+		depth = defaultQueueDepth
+	}
+
+	if len(queue) >= depth {
+		log.Warnf("Outgoing queue for %s is full, dropping oldest message: %s", m.ChatID, queue[0].Text)
+
+		queue = slices.Delete(queue, 0, 1)
+	}
+
+	scheduler.queues[key] = append(queue, m)
+	scheduler.Unlock()
+
+	scheduler.notify()
+}
+
+// EnqueuePriority ставит служебное сообщение в полосу, которая обслуживается раньше всех очередей.
+func (scheduler *sendScheduler) EnqueuePriority(m iMsg) {
+	scheduler.Lock()
+	scheduler.priority = append(scheduler.priority, m)
+	scheduler.Unlock()
+
+	scheduler.notify()
+}
+
+// notify будит отправляющую горутинку, если она ждёт сообщений.
+func (scheduler *sendScheduler) notify() {
+	select {
+	case scheduler.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Len возвращает количество сообщений во всех очередях, включая те, что уже достали из очереди, но ещё не отправили.
+func (scheduler *sendScheduler) Len() int {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+
+	count := len(scheduler.priority) + scheduler.inflight
+
+	for _, queue := range scheduler.queues {
+		count += len(queue)
+	}
+
+	return count
+}
+
+// pop достаёт следующее сообщение: вначале служебное, затем из очереди цели, чья очередь подошла. Цели, которым ещё
+// рано отправлять из-за собственной задержки, пропускаются, в этом случае возвращается, через сколько какая-то из них
+// освободится.
+func (scheduler *sendScheduler) pop(now time.Time) (iMsg, bool, time.Duration) {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+
+	if len(scheduler.priority) > 0 {
+		m := scheduler.priority[0]
+		scheduler.priority = scheduler.priority[1:]
+		scheduler.inflight++
+
+		return m, true, 0
+	}
+
+	var wait time.Duration
+
+	for i := 0; i < len(scheduler.order); i++ {
+		key := scheduler.order[i]
+		queue := scheduler.queues[key]
+
+		if len(queue) == 0 {
+			delete(scheduler.queues, key)
+			scheduler.order = slices.Delete(scheduler.order, i, i+1)
+			i--
+
+			continue
+		}
+
+		if notBefore, ok := scheduler.notBefore[key]; ok {
+			if until := notBefore.Sub(now); until > 0 {
+				if wait == 0 || until < wait {
+					wait = until
+				}
+
+				continue
+			}
+
+			delete(scheduler.notBefore, key)
+		}
+
+		m := queue[0]
+		queue = queue[1:]
+		scheduler.order = slices.Delete(scheduler.order, i, i+1)
+
+		if len(queue) > 0 {
+			// У цели ещё есть сообщения, она встаёт в конец круга.
+			scheduler.queues[key] = queue
+			scheduler.order = append(scheduler.order, key)
+		} else {
+			delete(scheduler.queues, key)
+		}
+
+		if delay := channelDelay(m.ChatID); delay > 0 {
+			scheduler.notBefore[key] = now.Add(delay)
+		}
+
+		scheduler.inflight++
+
+		return m, true, 0
+	}
+
+	return iMsg{}, false, wait
+}
+
+// next ждёт и возвращает следующее сообщение для отправки. Когда сообщение отправлено, надо вызвать done(). Если
+// ctx отменили раньше, чем появилось сообщение, то возвращает false.
+func (scheduler *sendScheduler) next(ctx context.Context) (iMsg, bool) {
+	for {
+		m, ok, wait := scheduler.pop(time.Now())
+
+		if ok {
+			return m, true
+		}
+
+		// Если ждать некого, то таймер нам не нужен, из nil-канала select никогда не читает
+		var timeout <-chan time.Time
+
+		var timer *time.Timer
+
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return iMsg{}, false
+		case <-scheduler.wake:
+		case <-timeout:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// done отмечает, что сообщение, полученное из next(), отправлено или выброшено.
+func (scheduler *sendScheduler) done() {
+	scheduler.Lock()
+	scheduler.inflight--
+	scheduler.Unlock()
+}
+
+// Drain ждёт, пока все сообщения из очередей будут отправлены, но не дольше, чем живёт ctx. Возвращает, сколько
+// сообщений отправить не успели.
+func (scheduler *sendScheduler) Drain(ctx context.Context) int {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		pending := scheduler.Len()
+
+		if pending == 0 {
+			return 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return pending
+		case <-ticker.C:
+		}
+	}
+}
+
+// rateLimiter реализует ограничения скорости отправки сообщений из конфига. Параметры читаются из конфига на каждом
+// сообщении.
+type rateLimiter struct {
+	// Последняя отправка сообщения.
+	last time.Time
+	// Количество токенов в "ведёрке" для token_bucket.
+	tokens float64
+}
+
+// wait ждёт, пока ограничение скорости позволит отправить очередное сообщение. Если у бота есть +o или +v на канале
+// назначения, то ограничение сервера мягче, поэтому вместо token bucket применяется только минимальная задержка. Если
+// ctx отменили раньше, то возвращает false.
+func (limiter *rateLimiter) wait(ctx context.Context, unrestricted bool) bool {
+	config := currentConfig()
+
+	rateLimit := config.Irc.RateLimit
+	now := time.Now()
+
+	switch {
+	case rateLimit.Type == "simple_delay" || (unrestricted && rateLimit.Type == "token_bucket"):
+		delay := time.Duration(rateLimit.SimpleDelay) * time.Millisecond
+
+		if elapsed := now.Sub(limiter.last); elapsed < delay {
+			log.Debugf("Due to simple delay waiting for %d milliseconds", (delay - elapsed).Milliseconds())
+
+			if !sleep(ctx, delay-elapsed) {
+				return false
+			}
+		}
+
+	case rateLimit.Type == "token_bucket":
+		size := float64(rateLimit.TokenBucket.Size)
+		// Каждые expiration_time секунд в "ведёрко" добавляется limit токенов, но не больше size.
+		refill := time.Duration(rateLimit.TokenBucket.ExpirationTime) * time.Second / time.Duration(max(rateLimit.TokenBucket.Limit, 1))
+
+		if limiter.last.IsZero() {
+			limiter.tokens = size
+		} else {
+			limiter.tokens = min(size, limiter.tokens+float64(now.Sub(limiter.last))/float64(refill))
+		}
+
+		log.Debugf("Message bucket has %.1f/%d tokens", limiter.tokens, rateLimit.TokenBucket.Size)
+
+		if limiter.tokens < 1 {
+			sleepPeriod := time.Duration((1 - limiter.tokens) * float64(refill))
+			log.Debugf("Message bucket is empty, hitting ratelimit, sleeping for %d milliseconds", sleepPeriod.Milliseconds())
+
+			if !sleep(ctx, sleepPeriod) {
+				return false
+			}
+
+			limiter.tokens = 1
+		}
+
+		limiter.tokens--
+	}
+
+	limiter.last = time.Now()
+
+	return true
+}
+
+// sleep спит period, либо пока не отменили ctx, в последнем случае возвращает false.
+func sleep(ctx context.Context, period time.Duration) bool {
+	timer := time.NewTimer(period)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// ircSend отправляет сообщения из планировщика в irc с применением ratelimit-ов. Длинные сообщения режутся на куски
+// ещё до попадания в очередь (см. irc-split.go), поэтому каждый кусок учитывается ограничителем скорости как отдельное
+// сообщение. Работает, пока не отменён ctx.
+func ircSend(ctx context.Context) {
+	var limiter rateLimiter
+
+	for {
+		m, ok := sender.next(ctx)
+
+		if !ok {
+			return
+		}
+
+		unrestricted := chanState.IsOped(m.ChatID, ircClient.GetNick()) || chanState.IsVoiced(m.ChatID, ircClient.GetNick())
+
+		if limiter.wait(ctx, unrestricted) {
+			ircDeliver(m)
+		}
+
+		sender.done()
+	}
+}
+
+// ircDeliver непосредственно отправляет сообщение в соединение с сервером, в зависимости от его типа.
+func ircDeliver(m iMsg) {
+	switch m.Kind {
+	case msgKindRaw:
+		log.Debugf("Sending raw command: %s", m.Text)
+		ircClient.SendRaw(m.Text)
+	case msgKindAction:
+		log.Debugf("Sending to chat %s action: %s", m.ChatID, m.Text)
+		ircClient.Action(m.ChatID, m.Text)
+	case msgKindNotice:
+		log.Debugf("Sending to chat %s notice: %s", m.ChatID, m.Text)
+		ircClient.Notice(m.ChatID, m.Text)
+	case msgKindCtcpReply:
+		log.Debugf("Sending to chat %s ctcp reply: %s", m.ChatID, m.Text)
+		ircClient.Notice(m.ChatID, "\x01"+m.Text+"\x01")
+	default:
+		log.Debugf("Sending to chat %s message: %s", m.ChatID, m.Text)
+		ircClient.Privmsg(m.ChatID, m.Text)
+	}
+}
+
+// ircJoin отправляет JOIN на канал по служебной полосе планировщика. Если у канала в конфиге есть ключ, то JOIN
+// отправляется с ключом.
+func ircJoin(channel string) {
+	command := "JOIN " + channel
+
+	if settings, ok := channelSettings(channel); ok && settings.Key != "" {
+		command += " " + settings.Key
+	}
+
+	sender.EnqueuePriority(iMsg{ChatID: channel, Text: command, Kind: msgKindRaw})
+}
+
+// ircPart отправляет PART с канала по служебной полосе планировщика.
+func ircPart(channel string) {
+	sender.EnqueuePriority(iMsg{ChatID: channel, Text: "PART " + channel, Kind: msgKindRaw})
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
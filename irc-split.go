@@ -0,0 +1,195 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+/* Нарезка исходящих сообщений на куски, которые гарантированно пролезут в одну строку протокола. Сервер пересылает
+ * наше сообщение остальным участникам в виде
+ *   :nick!user@host PRIVMSG #channel :text\r\n
+ * и всё, что не влезло в LINELEN (обычно 512 байт), просто отрезает, зачастую посередине utf-8 символа. Поэтому
+ * полезная нагрузка считается от нашего собственного префикса nick!user@host в том виде, в каком его видит сервер.
+ */
+
+// Максимальные длины user (с учётом ~, который добавляет сервер без identd) и host на случай, если мы ещё не знаем,
+// как нас видит сервер.
+const (
+	fallbackUserLen = 11
+	fallbackHostLen = 63
+)
+
+// ownPrefixLen возвращает длину нашего префикса nick!user@host так, как его видят остальные участники.
+func ownPrefixLen() int {
+	config := currentConfig()
+
+	// До подключения к серверу (например, когда из шины прилетели сообщения, накопившиеся, пока нас не было) ника от
+	// сервера у нас ещё нет
+	nick := config.Irc.Nick
+
+	if ircClient != nil {
+		nick = ircClient.GetNick()
+	}
+
+	if me, ok := chanState.User(nick); ok && me.User != "" && me.Host != "" {
+		return len(me.Hostmask())
+	}
+
+	// Мы ещё ни на одном канале, поэтому честный префикс нам неизвестен, считаем по худшему варианту.
+	return len(nick) + len("!") + fallbackUserLen + len("@") + fallbackHostLen
+}
+
+// ircPayloadLen возвращает, сколько байт текста влезет в одну строку команды command для цели target. ctcp - это
+// название CTCP-команды, в которую будет обёрнут текст, например, ACTION, либо пустая строка.
+func ircPayloadLen(command string, target string, ctcp string) int {
+	// ":" + prefix + " " + command + " " + target + " :" + text + "\r\n"
+	overhead := len(":") + ownPrefixLen() + len(" ") + len(command) + len(" ") + len(target) + len(" :") + len("\r\n")
+
+	if ctcp != "" {
+		// "\x01" + ctcp + " " + text + "\x01"
+		overhead += len("\x01") + len(ctcp) + len(" ") + len("\x01")
+	}
+
+	return isupport.LineLen() - overhead
+}
+
+// ircSplitMsg режет сообщение на куски, влезающие в одну строку протокола, с учётом того, какой командой и с какой
+// обёрткой оно будет отправлено.
+func ircSplitMsg(m iMsg) []iMsg {
+	var maxLen int
+
+	switch m.Kind {
+	case msgKindAction:
+		maxLen = ircPayloadLen("PRIVMSG", m.ChatID, "ACTION")
+	case msgKindNotice:
+		maxLen = ircPayloadLen("NOTICE", m.ChatID, "")
+	case msgKindCtcpReply, msgKindRaw:
+		// Ответы на CTCP и служебные команды короткие и резать их нельзя, иначе получатель их не поймёт.
+		return []iMsg{m}
+	default:
+		maxLen = ircPayloadLen("PRIVMSG", m.ChatID, "")
+	}
+
+	fragments := ircSplit(m.Text, maxLen)
+	messages := make([]iMsg, 0, len(fragments))
+
+	for _, fragment := range fragments {
+		messages = append(messages, iMsg{ChatID: m.ChatID, Text: fragment, Kind: m.Kind})
+	}
+
+	return messages
+}
+
+// ircSplit режет текст на куски, каждый из которых не длиннее maxLen байт. Резать старается по пробелам, никогда не
+// режет посередине utf-8 символа или кода форматирования IRC. Если в конфиге задан маркер продолжения, то он
+// дописывается к каждому куску, кроме последнего.
+func ircSplit(text string, maxLen int) []string {
+	config := currentConfig()
+
+	marker := config.Irc.SplitMarker
+
+	if len(text) <= maxLen {
+		return []string{text}
+	}
+
+	// Маркер не должен съедать больше половины строки, иначе толку от такой нарезки нет.
+	if len(marker) > maxLen/2 {
+		marker = ""
+	}
+
+	maxLen -= len(marker)
+
+	var fragments []string
+
+	for len(text) > maxLen {
+		cut := safeCut(text, maxLen)
+
+		// Если есть пробел не слишком далеко от конца куска, режем по нему, чтобы не разрывать слова.
+		if i := strings.LastIndexByte(text[:cut], ' '); i > maxLen/2 {
+			cut = i
+		}
+
+		fragments = append(fragments, strings.TrimRight(text[:cut], " ")+marker)
+		text = strings.TrimLeft(text[cut:], " ")
+	}
+
+	if text != "" {
+		fragments = append(fragments, text)
+	} else if len(fragments) > 0 {
+		// Текст закончился ровно на границе куска, маркер на последнем куске не нужен.
+		last := len(fragments) - 1
+		fragments[last] = strings.TrimSuffix(fragments[last], marker)
+	}
+
+	return fragments
+}
+
+// safeCut возвращает позицию не дальше n, в которой текст можно разрезать, не повредив utf-8 символ или код
+// форматирования.
+func safeCut(text string, n int) int {
+	cut := n
+
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+
+	// Коды цвета длинные, например, \x0304,12 или \x04FF0000,00FF00, проверим, не попадаем ли мы внутрь такого кода.
+	for i := cut - 1; i >= 0 && i >= cut-len("\x04FFFFFF,FFFFFF"); i-- {
+		if text[i] == '\x03' || text[i] == '\x04' {
+			if formatCodeEnd(text, i) > cut {
+				cut = i
+			}
+
+			break
+		}
+	}
+
+	// Если резать совсем негде (например, maxLen меньше одного символа), режем по границе первого символа, лишь бы
+	// не зациклиться.
+	if cut == 0 {
+		_, size := utf8.DecodeRuneInString(text)
+		cut = size
+	}
+
+	return cut
+}
+
+// formatCodeEnd возвращает позицию, на которой заканчивается код цвета, начинающийся в позиции start.
+func formatCodeEnd(text string, start int) int {
+	isDigit := func(b byte) bool { return b >= '0' && b <= '9' }
+	isHex := func(b byte) bool { return isDigit(b) || (b|0x20 >= 'a' && b|0x20 <= 'f') }
+
+	// \x03 - это цвет из палитры, 1-2 цифры, \x04 - это цвет в hex, ровно 6 символов.
+	check, minLen, maxLen := isDigit, 1, 2
+
+	if text[start] == '\x04' {
+		check, minLen, maxLen = isHex, 6, 6
+	}
+
+	colorEnd := func(pos int) int {
+		end := pos
+
+		for end < len(text) && end-pos < maxLen && check(text[end]) {
+			end++
+		}
+
+		if end-pos < minLen {
+			return pos
+		}
+
+		return end
+	}
+
+	end := colorEnd(start + 1)
+
+	// Если был цвет текста, то после запятой может идти цвет фона.
+	if end > start+1 && end < len(text) && text[end] == ',' {
+		if bgEnd := colorEnd(end + 1); bgEnd > end+1 {
+			end = bgEnd
+		}
+	}
+
+	return end
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -1,102 +1,135 @@
 package main
 
 import (
-	"context"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
-	"github.com/go-redis/redis/v8"
 	log "github.com/sirupsen/logrus"
 )
 
 // Производит некоторую инициализацию перед запуском main().
 func init() {
-	log.SetFormatter(&log.TextFormatter{
+	// Форматтер обёрнут, чтобы в лог не попадали пароли, см. config-secrets.go
+	logFormatter.Formatter = &log.TextFormatter{
 		DisableQuote:           true,
 		DisableLevelTruncation: false,
 		DisableColors:          true,
 		FullTimestamp:          true,
 		TimestampFormat:        "2006-01-02 15:04:05",
-	})
-
-	readConfig()
-
-	// no panic, no trace
-	switch config.Loglevel {
-	case "fatal":
-		log.SetLevel(log.FatalLevel)
-	case "error":
-		log.SetLevel(log.ErrorLevel)
-	case "warn":
-		log.SetLevel(log.WarnLevel)
-	case "info":
-		log.SetLevel(log.InfoLevel)
-	case "debug":
-		log.SetLevel(log.DebugLevel)
-	default:
-		log.SetLevel(log.InfoLevel)
 	}
 
-	// Проинициализируем мапку MODE-ами пользователей произвольным значением и удалим его
-	var usersModes = map[string]map[string]map[string]bool{
-		"user": {
-			"mode": {
-				"v": true,
-			},
-		},
-	}
-
-	userMode.Set("channel", usersModes)
-	userMode.Delete("channel")
+	log.SetFormatter(logFormatter)
 }
 
 // Собственно, какбэ "точка входа" - основная процедура в нашем боте.
 func main() {
-	// Main context
-	var ctx = context.Background()
+	flag.StringVar(&cmdline.ConfigPath, "config", "", "path to config file, by default it is searched by binary name")
+	flag.StringVar(&cmdline.DataDir, "data-dir", "", "override data_dir from config")
+	flag.BoolVar(&cmdline.CheckConfig, "check-config", false, "check config, print all problems and exit")
+	flag.BoolVar(&cmdline.DumpConfig, "dump-config", false, "print effective config with defaults and exit")
+	flag.Parse()
 
-	// Откроем лог и скормим его логгеру
-	if config.Log != "" {
-		logfile, err := os.OpenFile(config.Log, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	newConfig, location, err := readConfig()
+
+	if err != nil {
+		log.Errorf("Config was not loaded! Refusing to start: %s", err)
+		os.Exit(1)
+	}
 
-		if err != nil {
-			log.Fatalf("Unable to open log file %s: %s", config.Log, err)
+	problems := validateConfig(&newConfig)
+
+	if cmdline.CheckConfig {
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+
+		if configHasErrors(problems) {
+			fmt.Printf("Config %s has errors\n", location)
+			os.Exit(1)
 		}
 
-		log.SetOutput(logfile)
+		fmt.Printf("Config %s is OK\n", location)
+		os.Exit(0)
 	}
 
-	// Иницализируем redis-клиента
-	redisClient = redis.NewClient(&redis.Options{
-		Addr: fmt.Sprintf("%s:%d", config.Redis.Server, config.Redis.Port),
-	})
+	logConfigProblems(location, problems)
 
-	log.Debugf("Lazy connect() to redis at %s:%d", config.Redis.Server, config.Redis.Port)
-	subscriber = redisClient.Subscribe(ctx, config.Redis.MyChannel)
-	redisMsgChan := subscriber.Channel()
+	if configHasErrors(problems) {
+		log.Error("Config has errors! Refusing to start.")
+		os.Exit(1)
+	}
 
-	go ircClientRun()
-	go ircSend()
-	go ircSendUnrestricted()
+	setConfig(newConfig)
+
+	config := currentConfig()
+
+	botCommands.Load(config.Commands)
+	updateLogSecrets()
+	log.Infof("Using %s as config file", location)
+
+	if cmdline.DumpConfig {
+		if err := dumpConfig(os.Stdout, *config); err != nil {
+			log.Errorf("Unable to dump config: %s", err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	applyLogLevel()
+
+	// Откроем лог и скормим его логгеру
+	if err := openLog(config.Log); err != nil {
+		log.Fatal(err)
+	}
+
+	// Два инстанса с одним data_dir перепишут друг другу настройки каналов
+	if err := lockDataDir(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Иницализируем шину сообщений поверх redis-ки
+	client, err := newRedisBus()
+
+	if err != nil {
+		log.Fatalf("Unable to prepare redis client: %s", err)
+	}
+
+	bus = client
+
+	// Redis-ка может подняться и позже, клиент к ней переподключится сам
+	if err := bus.Health(ctx); err != nil {
+		log.Warnf("Redis is not available yet: %s", err)
+	}
+
+	go ircClientRun(ctx)
+	go ircSend(senderCtx)
 
 	// Самое время поставить траппер сигналов
 	signal.Notify(sigChan,
 		syscall.SIGINT,
 		syscall.SIGTERM,
-		syscall.SIGQUIT)
+		syscall.SIGQUIT,
+		syscall.SIGHUP)
 
 	go sigHandler()
 
 	// Обработчик событий от редиски
-	for msg := range redisMsgChan {
-		if shutdown {
-			continue
-		}
+	go bus.Subscribe(ctx, busMsgParser)
 
-		redisMsgParser(msg.Payload)
-	}
+	// Команды, которые объявляют сервисы бота
+	go commandDiscovery(ctx)
+
+	// Счётчики сообщений, выкинутых защитой от зацикливания
+	go forwardStats(ctx)
+
+	// Работаем, пока хэндлер сигналов не скажет, что пора выключаться
+	<-ctx.Done()
+
+	gracefulShutdown()
 }
 
 /* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
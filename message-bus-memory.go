@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"sync"
+)
+
+// Ошибки шины в памяти процесса.
+var (
+	errBusClosed = errors.New("message bus is closed")
+	errBusFull   = errors.New("message bus queue is full")
+)
+
+// memoryBus - это шина сообщений в памяти процесса. То, что мы отправляем роутеру, складывается в очередь, откуда его
+// можно достать через Outgoing(), сообщения об ошибках - через Nacks(), а сообщения для нас туда подкладываются через
+// Deliver().
+type memoryBus struct {
+	sync.RWMutex
+	incoming chan rMsg
+	outgoing chan sMsg
+	nacks    chan nMsg
+	// Объявления команд от сервисов бота.
+	commands map[string]string
+	closed   bool
+}
+
+// newMemoryBus создаёт шину в памяти процесса с очередями глубиной depth в каждую сторону.
+func newMemoryBus(depth int) *memoryBus {
+	return &memoryBus{
+		incoming: make(chan rMsg, depth),
+		outgoing: make(chan sMsg, depth),
+		nacks:    make(chan nMsg, depth),
+		commands: make(map[string]string),
+	}
+}
+
+// Publish кладёт сообщение в очередь исходящих. Вызывающий не блокируется, если очередь переполнена, сообщение
+// отбрасывается с ошибкой - так же, как pubsub теряет сообщения, когда их некому читать.
+func (b *memoryBus) Publish(_ context.Context, msg sMsg) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.closed {
+		return errBusClosed
+	}
+
+	select {
+	case b.outgoing <- msg:
+		return nil
+	default:
+		return errBusFull
+	}
+}
+
+// Nack кладёт сообщение об ошибке в очередь ошибок, адресат в шине в памяти не важен.
+func (b *memoryBus) Nack(_ context.Context, _ string, nack nMsg) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.closed {
+		return errBusClosed
+	}
+
+	select {
+	case b.nacks <- nack:
+		return nil
+	default:
+		return errBusFull
+	}
+}
+
+// Subscribe передаёт обработчику сообщения, подложенные через Deliver(), пока не отменён ctx или шина не закрыта.
+func (b *memoryBus) Subscribe(ctx context.Context, handler func(rMsg)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-b.incoming:
+			if !ok {
+				return
+			}
+
+			handler(msg)
+		}
+	}
+}
+
+// Commands возвращает копию объявлений команд, подложенных через Announce().
+func (b *memoryBus) Commands(_ context.Context) (map[string]string, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.closed {
+		return nil, errBusClosed
+	}
+
+	return maps.Clone(b.commands), nil
+}
+
+// Health сообщает, не закрыта ли шина.
+func (b *memoryBus) Health(_ context.Context) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.closed {
+		return errBusClosed
+	}
+
+	return nil
+}
+
+// Close закрывает шину, Subscribe() и читатели Outgoing() после этого завершаются.
+func (b *memoryBus) Close() error {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		return errBusClosed
+	}
+
+	b.closed = true
+	close(b.incoming)
+	close(b.outgoing)
+	close(b.nacks)
+
+	return nil
+}
+
+// Deliver подкладывает в шину сообщение для нас, как если бы его прислал роутер. Блокируется, пока в очереди нет
+// места или не отменён ctx.
+func (b *memoryBus) Deliver(ctx context.Context, msg rMsg) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.closed {
+		return errBusClosed
+	}
+
+	select {
+	case b.incoming <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Announce подкладывает в шину объявление команд сервиса service, пустое объявление удаляет прежнее.
+func (b *memoryBus) Announce(service string, announcement string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if announcement == "" {
+		delete(b.commands, service)
+
+		return
+	}
+
+	b.commands[service] = announcement
+}
+
+// Outgoing возвращает очередь сообщений, которые мы отправили роутеру.
+func (b *memoryBus) Outgoing() <-chan sMsg {
+	return b.outgoing
+}
+
+// Nacks возвращает очередь сообщений об ошибках, которые мы отправили.
+func (b *memoryBus) Nacks() <-chan nMsg {
+	return b.nacks
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+/* Тесты прохождения сообщений через шину в памяти процесса: из шины в очередь отправки в IRC, из IRC в шину и nack-и
+ * на неправильные сообщения. Вместо redis-ки в bus подставляется memoryBus, а вместо сервера - неподключенный клиент.
+ */
+
+// Сколько ждём, пока сообщение пройдёт через шину.
+const busTestTimeout = time.Second
+
+// withMemoryBus подставляет на время теста шину в памяти, конфиг и пустые очереди отправки.
+func withMemoryBus(t *testing.T) *memoryBus {
+	t.Helper()
+
+	previousBus, previousConfig, previousSender := bus, currentConfig(), sender
+	previousEchoes, previousCommands, previousClient := forwardEchoes, botCommands, ircClient
+
+	config := myConfig{Csign: "!", ForwardsMax: 5}
+	config.Redis.MyChannel = "irc"
+	config.Redis.Nack = true
+	config.Redis.Registry.Key = "aleesa:commands"
+	config.Irc.Nick = "aleesa"
+
+	mem := newMemoryBus(8)
+	bus = mem
+	sender = newSendScheduler()
+	forwardEchoes = newForwardTracker()
+	botCommands = newCommandRegistry()
+	ircClient = irc.IRC("aleesa", "aleesa")
+
+	setConfig(config)
+
+	t.Cleanup(func() {
+		_ = mem.Close()
+		bus, sender, forwardEchoes, botCommands, ircClient = previousBus, previousSender, previousEchoes, previousCommands,
+			previousClient
+
+		setConfig(*previousConfig)
+	})
+
+	return mem
+}
+
+// routerMsg собирает сообщение от роутера в канал #chan.
+func routerMsg(text string) rMsg {
+	var msg rMsg
+	msg.Version = msgSchemaVersion
+	msg.From = "router"
+	msg.Chatid = "#chan"
+	msg.Userid = "alice"
+	msg.Message = text
+	msg.Plugin = "irc"
+	msg.Mode = "public"
+	msg.Misc.Answer = 1
+
+	return msg
+}
+
+// subscribe разбирает сообщения из шины busMsgParser-ом и возвращает канал, в который приходит по сигналу на каждое
+// разобранное сообщение.
+func subscribe(t *testing.T, mem *memoryBus) <-chan struct{} {
+	t.Helper()
+
+	subscriberCtx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	handled := make(chan struct{}, 1)
+
+	go mem.Subscribe(subscriberCtx, func(msg rMsg) {
+		busMsgParser(msg)
+		handled <- struct{}{}
+	})
+
+	return handled
+}
+
+// queued достаёт из очереди отправки все обычные сообщения, служебные (например, WHOIS) пропускаются.
+func queued() []iMsg {
+	var messages []iMsg
+
+	for {
+		m, ok, _ := sender.pop(time.Now())
+
+		if !ok {
+			return messages
+		}
+
+		sender.done()
+
+		if m.Kind != msgKindRaw {
+			messages = append(messages, m)
+		}
+	}
+}
+
+func TestMemoryBusToIrc(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []iMsg
+	}{
+		{"plain text", "привет", []iMsg{{ChatID: "#chan", Text: "привет", Kind: msgKindPrivmsg}}},
+		{"legacy action", "/me машет лапкой", []iMsg{{ChatID: "#chan", Text: "машет лапкой", Kind: msgKindAction}}},
+		{
+			"multiline",
+			"раз\r\n\nдва",
+			[]iMsg{{ChatID: "#chan", Text: "раз", Kind: msgKindPrivmsg}, {ChatID: "#chan", Text: "два", Kind: msgKindPrivmsg}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mem := withMemoryBus(t)
+			handled := subscribe(t, mem)
+
+			if err := mem.Deliver(context.Background(), routerMsg(test.text)); err != nil {
+				t.Fatalf("Deliver() = %s", err)
+			}
+
+			select {
+			case <-handled:
+			case <-time.After(busTestTimeout):
+				t.Fatal("message was not handled")
+			}
+
+			got := queued()
+
+			if len(got) != len(test.want) {
+				t.Fatalf("queued %+v, want %+v", got, test.want)
+			}
+
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("queued[%d] = %+v, want %+v", i, got[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryBusNoAnswer(t *testing.T) {
+	withMemoryBus(t)
+
+	msg := routerMsg("не отвечать")
+	msg.Misc.Answer = 0
+
+	busMsgParser(msg)
+
+	if got := queued(); len(got) != 0 {
+		t.Errorf("queued %+v for message without answer", got)
+	}
+}
+
+func TestMemoryBusFromIrc(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		answer int64
+	}{
+		{"command", "!ping", 1},
+		{"addressed to bot", "aleesa, привет", 1},
+		{"addressed in other case", "ALEESA, привет", 1},
+		{"karma", "котики++", 1},
+		{"chatter", "просто трёп", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mem := withMemoryBus(t)
+
+			ircMsgParser("#chan", "alice", "alice", "alice!alice@host.tld", test.text, nil, msgKindPrivmsg)
+
+			select {
+			case msg := <-mem.Outgoing():
+				if msg.Message != test.text || msg.Chatid != "#chan" || msg.From != "irc" || msg.Misc.Username != "alice" {
+					t.Errorf("published %+v for %q", msg, test.text)
+				}
+
+				if msg.Misc.Answer != test.answer {
+					t.Errorf("answer %d for %q, want %d", msg.Misc.Answer, test.text, test.answer)
+				}
+			default:
+				t.Fatalf("nothing published for %q", test.text)
+			}
+		})
+	}
+}
+
+func TestMemoryBusFromIrcSpecialNick(t *testing.T) {
+	mem := withMemoryBus(t)
+	ircClient = irc.IRC("aleesa[m]", "aleesa")
+
+	ircMsgParser("#chan", "alice", "alice", "alice!alice@host.tld", "aleesa{m}: привет", nil, msgKindPrivmsg)
+
+	select {
+	case msg := <-mem.Outgoing():
+		if msg.Misc.Answer != 1 {
+			t.Errorf("answer %d for message addressed to aleesa[m], want 1", msg.Misc.Answer)
+		}
+	default:
+		t.Fatal("nothing published")
+	}
+}
+
+func TestMemoryBusUnknownCommand(t *testing.T) {
+	mem := withMemoryBus(t)
+
+	ircMsgParser("#chan", "alice", "alice", "alice!alice@host.tld", "!nosuchcommand", nil, msgKindPrivmsg)
+
+	select {
+	case msg := <-mem.Outgoing():
+		t.Errorf("published %+v for unknown command", msg)
+	default:
+	}
+}
+
+func TestMemoryBusChannelPlugins(t *testing.T) {
+	mem := withMemoryBus(t)
+
+	// Погода разрешена по синониму, но вызвать её можно как угодно
+	config := *currentConfig()
+	config.Irc.Channels = []channelConfig{{Name: "#chan", Plugins: []string{"weather"}}}
+	setConfig(config)
+
+	for text, want := range map[string]bool{"!w Москва": true, "!погода Москва": true, "!karma котики": false} {
+		ircMsgParser("#chan", "alice", "alice", "alice!alice@host.tld", text, nil, msgKindPrivmsg)
+
+		select {
+		case msg := <-mem.Outgoing():
+			if !want {
+				t.Errorf("published %q, but it is not enabled on #chan", msg.Message)
+			}
+		default:
+			if want {
+				t.Errorf("%q not published", text)
+			}
+		}
+	}
+}
+
+func TestMemoryBusForwardLimit(t *testing.T) {
+	mem := withMemoryBus(t)
+
+	// Отправка в IRC - пятая пересылка, это ещё можно
+	msg := routerMsg("пересылаемая по кругу фраза")
+	msg.Misc.Fwdcnt = 4
+	busMsgParser(msg)
+
+	if got := queued(); len(got) != 1 {
+		t.Fatalf("queued %+v, want message with fwd_cnt 4", got)
+	}
+
+	// Другой бот повторил её в канале, это уже шестая
+	ircMsgParser("#chan", "otherbot", "otherbot", "otherbot!bot@host.tld", "<alice> пересылаемая по кругу фраза", nil,
+		msgKindPrivmsg)
+
+	select {
+	case msg := <-mem.Outgoing():
+		t.Errorf("published %+v over forwards_max", msg)
+	default:
+	}
+
+	// А эта станет шестой уже при отправке в IRC
+	msg.Misc.Fwdcnt = 5
+	busMsgParser(msg)
+
+	if got := queued(); len(got) != 0 {
+		t.Errorf("queued %+v over forwards_max", got)
+	}
+}
+
+func TestMemoryBusNack(t *testing.T) {
+	mem := withMemoryBus(t)
+
+	msg := routerMsg("")
+	busMsgParser(msg)
+
+	select {
+	case nack := <-mem.Nacks():
+		if nack.Type != nackType || nack.From != "irc" || nack.Chatid != "#chan" || !strings.Contains(nack.Error, "no message") {
+			t.Errorf("nack %+v", nack)
+		}
+	default:
+		t.Fatal("no nack for message without text")
+	}
+
+	// На свои же сообщения nack не отправляем, иначе ответим сами себе
+	msg.From = "irc"
+	busMsgParser(msg)
+
+	select {
+	case nack := <-mem.Nacks():
+		t.Errorf("nack %+v sent to ourselves", nack)
+	default:
+	}
+
+	if got := queued(); len(got) != 0 {
+		t.Errorf("queued %+v for rejected messages", got)
+	}
+}
+
+func TestMemoryBusAnnounce(t *testing.T) {
+	mem := withMemoryBus(t)
+
+	mem.Announce("weather", `{"commands": [{"name": "метео", "aliases": ["meteo"], "args": "text", "help": "погода"}]}`)
+
+	announcements := discoverCommands(context.Background(), nil)
+
+	if _, ok := botCommands.Lookup("meteo"); !ok || len(announcements) != 1 {
+		t.Fatalf("announced command not discovered, announcements %q", announcements)
+	}
+
+	ircMsgParser("#chan", "alice", "alice", "alice!alice@host.tld", "!meteo Москва", nil, msgKindPrivmsg)
+
+	select {
+	case msg := <-mem.Outgoing():
+		if msg.Message != "!meteo Москва" {
+			t.Errorf("published %q, want !meteo Москва", msg.Message)
+		}
+	default:
+		t.Fatal("announced command not published")
+	}
+
+	mem.Announce("weather", "")
+
+	if announcements := discoverCommands(context.Background(), announcements); len(announcements) != 0 {
+		t.Errorf("announcements %q after withdrawal", announcements)
+	}
+}
+
+func TestMemoryBusLimits(t *testing.T) {
+	mem := newMemoryBus(1)
+
+	if err := mem.Publish(context.Background(), sMsg{}); err != nil {
+		t.Fatalf("Publish() = %s", err)
+	}
+
+	if err := mem.Publish(context.Background(), sMsg{}); !errors.Is(err, errBusFull) {
+		t.Errorf("Publish() to full queue = %v, want %s", err, errBusFull)
+	}
+
+	if err := mem.Nack(context.Background(), "router", nMsg{}); err != nil {
+		t.Fatalf("Nack() = %s", err)
+	}
+
+	if err := mem.Nack(context.Background(), "router", nMsg{}); !errors.Is(err, errBusFull) {
+		t.Errorf("Nack() to full queue = %v, want %s", err, errBusFull)
+	}
+
+	if err := mem.Health(context.Background()); err != nil {
+		t.Errorf("Health() = %s", err)
+	}
+
+	if err := mem.Close(); err != nil {
+		t.Fatalf("Close() = %s", err)
+	}
+
+	for name, err := range map[string]error{
+		"Publish": mem.Publish(context.Background(), sMsg{}),
+		"Nack":    mem.Nack(context.Background(), "router", nMsg{}),
+		"Deliver": mem.Deliver(context.Background(), rMsg{}),
+		"Health":  mem.Health(context.Background()),
+		"Close":   mem.Close(),
+	} {
+		if !errors.Is(err, errBusClosed) {
+			t.Errorf("%s() on closed bus = %v, want %s", name, err, errBusClosed)
+		}
+	}
+
+	if _, err := mem.Commands(context.Background()); !errors.Is(err, errBusClosed) {
+		t.Errorf("Commands() on closed bus = %v, want %s", err, errBusClosed)
+	}
+
+	// Subscribe() на закрытой шине сразу завершается
+	mem.Subscribe(context.Background(), func(rMsg) { t.Error("message from closed bus") })
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+)
+
+/* Шина сообщений, по которой мы обмениваемся сообщениями с роутером. В бою это redis-ка (redisBus, см.
+ * redis-client.go), а для тестов и встраивания есть шина в памяти процесса (memoryBus, см. message-bus-memory.go), с
+ * ней весь путь сообщения из IRC в роутер и обратно можно прогнать без живой redis-ки.
+ */
+
+// messageBus - это транспорт сообщений между нами и роутером.
+type messageBus interface {
+	// Publish отправляет сообщение роутеру.
+	Publish(ctx context.Context, msg sMsg) error
+	// Nack отправляет сообщение об ошибке в канал to, см. msg-schema.go.
+	Nack(ctx context.Context, to string, nack nMsg) error
+	// Subscribe передаёт обработчику сообщения для нас, пока не отменён ctx. Вызывающий блокируется на это время.
+	Subscribe(ctx context.Context, handler func(rMsg))
+	// Commands возвращает объявления команд от сервисов бота: имя сервиса -> json с его командами, см.
+	// command-discovery.go.
+	Commands(ctx context.Context) (map[string]string, error)
+	// Health проверяет, что шина работоспособна.
+	Health(ctx context.Context) error
+	// Close освобождает ресурсы шины, после этого пользоваться ей нельзя.
+	Close() error
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
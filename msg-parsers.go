@@ -5,333 +5,203 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// Разделитель строк в тексте, пришедшем с шины: сервисы присылают и unix-, и windows-переводы строк.
+var busLineSeparator = regexp.MustCompile("\r?\n")
+
 // ircMsgParser парсит сообщения, прилетевшие из IRC-ки.
-func ircMsgParser(channel string, nick string, user string, source string, msg string) { //nolint: revive
+func ircMsgParser(channel string, nick string, user string, source string, msg string, tags map[string]string, kind msgKind) { //nolint: revive
+	config := currentConfig()
+
 	// nick - это выбранный пользователем nick (если он занят, то его "нарисует" сервер)
 	// user - это короткое имя пользователя, под которым его видит сервер
 	// source - это длинное имя пользователя, оно содержит в себе помимо user, ещё и ip с которого пришёл пользователь
-	if shutdown {
+	// tags - это IRCv3 тэги сообщения, из них мы берём services account отправителя и время сообщения на сервере
+	// kind - это тип сообщения: privmsg, action (/me) или notice, текст action-а приходит уже без CTCP-обёртки
+	if shuttingDown() {
 		// Если мы завершаем работу программы, то нам ничего обрабатывать не надо
 		return
 	}
 
-	if channel == ircClient.GetNick() {
-		// В привате бот не отвечает, чтобы не было возможности DDoS-а, ratelimit-ы в irc слишком жёсткие
-		// TODO: возможно, это имеет смысл вынести в конфиг, но это если кому-то кроме меня бот будет интересен
+	// Наши собственные сообщения, которые вернул нам сервер, пересылать нельзя, см. forward-loop.go
+	if isMe(nick) {
+		forwardDrops.Add("echo", 1)
+		log.Debugf("Ignoring own message echoed back to %s", channel)
+
 		return
 	}
 
+	// Если это наш же текст, который кто-то повторил, то это пересылка, и счётчик у неё на единицу больше
+	var fwdcnt int64
+
+	if echoed, ok := forwardEchoes.Lookup(msg, time.Now()); ok {
+		fwdcnt = echoed + 1
+
+		if !forwardAllowed("outgoing", fwdcnt) {
+			log.Warnf("Dropping msg from %s on %s, it has been forwarded %d times, forwards_max is %d",
+				nick, channel, fwdcnt, config.ForwardsMax)
+
+			return
+		}
+	}
+
+	// В public-е сообщение адресовано каналу, в привате - нам
+	mode := "public"
+
+	if isMe(channel) {
+		// На NOTICE-ы в привате не отвечаем, а прочие сообщения обрабатываем, только если приват разрешён в конфиге,
+		// см. irc-private.go
+		if kind == msgKindNotice || !privateAccept(nick, source, tagAccount(tags)) {
+			return
+		}
+
+		// Отвечать в привате надо отправителю, а не нам самим
+		channel = nick
+		mode = "private"
+	}
+
+	// Префикс команд может быть своим для каждого канала
+	csign := channelCsign(channel)
+
 	// Ловим команды и обрабатываем их
-	if (len(msg) > len(config.Csign)) && (msg[:len(config.Csign)] == config.Csign) {
+	// Команды бывают только в обычных сообщениях, "/me !ping" - это не команда
+	if kind == msgKindPrivmsg && (len(msg) > len(csign)) && (msg[:len(csign)] == csign) {
 		var outgoingMessage string
 
 		var message sMsg
+		message.Version = msgSchemaVersion
 		message.From = config.Redis.MyChannel
 		message.Userid = user    // как его видит сервер
 		message.Chatid = channel // чятик, в который написал user
 		message.Threadid = ""    // тредиков в irc нету, поэтому это поле отправляем пустым
 		message.Plugin = config.Redis.MyChannel
-		message.Mode = "public"
+		message.Mode = mode
 		// Предполагается, что на команды бот автоматом отвечает
 		message.Misc.Answer = 1
-		message.Misc.Fwdcnt = 0
-		message.Misc.Csign = config.Csign
+		message.Misc.Fwdcnt = fwdcnt
+		message.Misc.Csign = csign
 		message.Misc.Username = nick
 		message.Misc.Botnick = config.Irc.Nick
 		message.Misc.Msgformat = 0
+		message.Misc.Account = tagAccount(tags)
+		message.Misc.ServerTime = tagServerTime(tags).Format(time.RFC3339Nano)
+		message.Misc.MsgType = string(kind)
 
-		var cmd = msg[len(config.Csign):]
+		var cmd = msg[len(csign):]
 
 		switch {
 		case cmd == "help" || msg == "помощь":
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%shelp | %sпомощь             - это сообщение", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sanek | %sанек | %sанекдот    - рандомный анекдот с anekdot.ru", config.Csign, config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sbuni                       - комикс-стрип hapi buni", config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sbunny                      - кролик", config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%srabbit | %sкролик           - кролик", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%scat | %sкис                 - кошечка", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sdice | %sroll | %sкости      - бросить кости", config.Csign, config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sdig | %sкопать              - заняться археологией", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sdrink | %sпраздник          - какой сегодня праздник?", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sfish | %sfisher             - порыбачить", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sрыба | %sрыбка | %sрыбалка   - порыбачить", config.Csign, config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sf | %sф                     - рандомная фраза из сборника цитат fortune_mod", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sfortune | %sфортунка        - рандомная фраза из сборника цитат fortune_mod", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sfox | %sлис                 - лисичка", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sfriday | %sпятница          - а не пятница ли сегодня?", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sfrog | %sлягушка            - лягушка", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%shorse | %sлошадь | %sлошадка - лошадка", config.Csign, config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%skarma фраза                - посмотреть карму фразы", config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sкарма фраза                - посмотреть карму фразы", config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintln("фраза++ | фраза--           - повысить или понизить карму фразы")}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%slat | %sлат                 - сгенерировать фразу из крылатого латинского выражения", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%smonkeyuser                 - комикс-стрип MonkeyUser", config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sowl | %sсова                - сова", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sping | %sпинг               - попинговать бота", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sproverb | %sпословица       - рандомная русская пословица", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%ssnail | %sулитка            - улитка", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%ssome_brew                  - выдать соответствующий напиток, бармен может налить rum, ром, vodka, водку, tequila, текила, whisky, виски, absinthe, абсент", config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sver | %sversion             - написать что-то про версию ПО", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sверсия                     - написать что-то про версию ПО", config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sw <город> | %sп <город>     - погода в городе", config.Csign, config.Csign)}
-			imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sxkcd                       - комикс-стрип с xkcb.ru", config.Csign)}
-
-			if userModeIsOped(channel, nick) {
-				imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sadmin                      - настройки некоторых плагинов бота для канала", config.Csign)}
-			}
-
-			return
-
-		case cmd == "admin":
-			if userModeIsOped(channel, nick) {
-				imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sadmin oboobs #        - где 1 - вкл, 0 - выкл плагина oboobs", config.Csign)}
-				imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sadmin oboobs         показываем ли сисечки по просьбе участников чата (команды %stits, %stities, %sboobs, %sboobies, %sсиси, %sсисечки)", config.Csign, config.Csign, config.Csign, config.Csign, config.Csign, config.Csign, config.Csign)}
-				imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sadmin obutts #        - где 1 - вкл, 0 - выкл плагина obutts", config.Csign)}
-				imChan <- iMsg{ChatID: nick, Text: fmt.Sprintf("%sadmin obutts         показываем ли попки по просьбе участников чата (команды %sass, %sbutt, %sbooty, %sпопа, %sпопка)", config.Csign, config.Csign, config.Csign, config.Csign, config.Csign, config.Csign)}
-			}
-
-			return
-
-		case cmd == "admin oboobs":
-			if userModeIsOped(channel, nick) {
-				value := getSetting(channel, "oboobs")
-
-				switch value {
-				case "":
-					_ = saveSetting(channel, "oboobs", "0")
-					imChan <- iMsg{ChatID: nick, Text: "Плагин oboobs выключен"}
-				case "0":
-					imChan <- iMsg{ChatID: nick, Text: "Плагин oboobs выключен"}
-				case "1":
-					imChan <- iMsg{ChatID: nick, Text: "Плагин oboobs включен"}
-				default:
-					imChan <- iMsg{ChatID: nick, Text: "Плагин oboobs выключен"}
+			// Список команд собирается из реестра, см. command-registry.go
+			entries := []helpEntry{{Usage: fmt.Sprintf("%shelp | %sпомощь", csign, csign), Help: "это сообщение"}}
+			entries = append(entries, botCommands.Help(csign, channel, mode)...)
+			entries = append(entries, helpEntry{Usage: "фраза++ | фраза--", Help: "повысить или понизить карму фразы"})
+
+			// Права бывают только на канале, в привате их не у кого спрашивать. Кто прислал команду, опознаём только
+			// там, где нужны права, см. irc-acl.go и irc-identity.go
+			if mode == "public" {
+				caller, identified := identities.Resolve(nick, source, tags, time.Now())
+
+				if identified && aclRoleOf(channel, caller) >= roleTrusted {
+					entries = append(entries,
+						helpEntry{Usage: csign + "admin", Help: "настройки некоторых плагинов бота для канала"})
 				}
 			}
 
-			return
-
-		case cmd == "admin oboobs 1":
-			if userModeIsOped(channel, nick) {
-				err := saveSetting(channel, "oboobs", "1")
-
-				if err != nil {
-					imChan <- iMsg{ChatID: nick, Text: "Плагин oboobs всё ещё выключен"}
-				} else {
-					imChan <- iMsg{ChatID: nick, Text: "Плагин oboobs включен"}
-				}
+			for _, line := range formatHelp(entries) {
+				sender.Enqueue(iMsg{ChatID: nick, Text: line})
 			}
 
 			return
 
-		case cmd == "admin oboobs 0":
-			if userModeIsOped(channel, nick) {
-				_ = saveSetting(channel, "oboobs", "0")
-				imChan <- iMsg{ChatID: nick, Text: "Плагин oboobs выключен"}
-			}
-
-			return
+		case cmd == "admin" || strings.HasPrefix(cmd, "admin "):
+			// Настройки отключаемых плагинов, см. plugin-toggles.go, и права на них, см. irc-acl.go. Они у каждого
+			// канала свои, а в привате channel - это ник собеседника
+			if mode == "private" {
+				sender.Enqueue(iMsg{ChatID: nick, Text: csign + "admin работает только на канале", Kind: msgKindNotice})
 
-		case cmd == "admin obutts":
-			if userModeIsOped(channel, nick) {
-				value := getSetting(channel, "obutts")
-
-				switch value {
-				case "":
-					_ = saveSetting(channel, "obutts", "0")
-					imChan <- iMsg{ChatID: nick, Text: "Плагин obutts выключен"}
-				case "0":
-					imChan <- iMsg{ChatID: nick, Text: "Плагин obutts выключен"}
-				case "1":
-					imChan <- iMsg{ChatID: nick, Text: "Плагин obutts включен"}
-				default:
-					imChan <- iMsg{ChatID: nick, Text: "Плагин obutts выключен"}
-				}
+				return
 			}
 
-			return
+			caller, identified := identities.Resolve(nick, source, tags, time.Now())
 
-		case cmd == "admin obutts 1":
-			if userModeIsOped(channel, nick) {
-				err := saveSetting(channel, "obutts", "1")
+			if !identified {
+				sender.Enqueue(iMsg{
+					ChatID: nick,
+					Text:   "Пока не могу понять, кто вы: жду от сервера ответа на WHOIS. Повторите команду через несколько секунд",
+					Kind:   msgKindNotice,
+				})
 
-				if err != nil {
-					imChan <- iMsg{ChatID: nick, Text: "Плагин obutts всё ещё выключен"}
-				} else {
-					imChan <- iMsg{ChatID: nick, Text: "Плагин obutts включен"}
-				}
+				return
 			}
 
-			return
-
-		case cmd == "admin obutts 0":
-			if userModeIsOped(channel, nick) {
-				_ = saveSetting(channel, "obutts", "0")
-				imChan <- iMsg{ChatID: nick, Text: "Плагин obutts выключен"}
+			if role := aclRoleOf(channel, caller); role >= roleTrusted {
+				adminCommand(channel, caller, role, csign, strings.TrimPrefix(cmd, "admin"))
 			}
 
 			return
 
 		default:
-			var done = false
-
-			// Общий список простых команд
-			cmds := []string{"ping", "пинг", "пинх", "pong", "понг", "понх", "coin", "монетка", "roll", "dice", "кости",
-				"ver", "version", "версия", "хэлп", "halp", "kde", "кде", "lat", "лат", "friday", "пятница", "proverb",
-				"пословица", "пословиться", "fortune", "фортунка", "f", "ф", "anek", "анек", "анекдот", "buni", "cat",
-				"кис", "drink", "праздник", "fox", "лис", "frog", "лягушка", "horse", "лошадь", "лошадка", "monkeyuser",
-				"owl", "сова", "сыч", "rabbit", "bunny", "кролик", "snail", "улитка", "xkcd", "dig", "копать", "fish",
-				"fishing", "рыба", "рыбка", "рыбалка", "karma", "карма", "w", "п", "weather", "погода", "погодка",
-				"погадка"}
-
-			for _, command := range cmds {
-				if cmd == command {
-					done = true
-					outgoingMessage = msg
-
-					break
-				}
-			}
-
-			// Список команд бармэна
-			if !done {
-				cmds := []string{"rum", "ром", "vodka", "водка", "beer", "пиво", "tequila", "текила", "whisky", "виски",
-					"absinthe", "абсент"}
-
-				// Тихо сам с собою я веду беседу...
-				for _, command := range cmds {
-					if cmd == command {
-						done = true
-						outgoingMessage = msg
-
-						break
-					}
-				}
-
+			name, args, _ := strings.Cut(cmd, " ")
+			args = strings.TrimSpace(args)
+			spec, ok := botCommands.Lookup(name)
+
+			switch {
+			case !ok || !commandAvailable(spec, channel, mode):
+				// Такой команды нет или на этом канале она выключена
+			case !channelPluginEnabled(channel, spec):
+				// Может быть, на этом канале эта команда не нужна
+				log.Debugf("Command %s is not enabled on %s, skipping", spec.Name, channel)
+			case spec.Args == cmdArgsText:
+				outgoingMessage = msg
+			case spec.Args == cmdArgsNick && args != "":
 				// Заказываю выпивку кому-то ещё
-				if !done {
-					re := regexp.MustCompile(" +")
-					pile := re.Split(cmd, 2)
-
-					for _, command := range cmds {
-						if pile[0] == command {
-							userNick := strings.TrimSpace(pile[1])
-
-							if userNick != "" {
-								if userModeIsHere(channel, userNick) {
-									// Проставляем правильный в конкретно данном случае username, так как отвечать мы
-									// будем ему
-									message.Misc.Username = strings.TrimSpace(pile[1])
-								} else {
-									msg = fmt.Sprintf("Я тут не вижу участника с ником %s", userNick)
-									imChan <- iMsg{ChatID: channel, Text: msg}
-
-									return
-								}
-							} // в противном случае юзер просто поставил пробел на конце команды, интерпретируем это как
-							//   стаканчик юзеру
-
-							outgoingMessage = msg
-							done = true
-
-							break
-						}
-					}
-				}
-			}
-
-			// Сложные команды, например, погода
-			if !done {
-				cmdLen := len(cmd)
-
-				cmds := []string{"w ", "п ", "погода ", "погодка ", "погадка ", "weather "}
-
-				for _, command := range cmds {
-					if cmdLen > len(command) && cmd[0:len(command)] == command {
-						done = true
-						outgoingMessage = msg
-
-						break
-					}
-				}
-			}
-
-			// Отключаемые команды
-			if !done {
-				value := getSetting(channel, "obutts")
+				if !chanState.IsHere(channel, args) {
+					sender.Enqueue(iMsg{ChatID: channel, Text: fmt.Sprintf("Я тут не вижу участника с ником %s", args)})
 
-				if value == "1" {
-					cmds := []string{"butt", "booty", "ass", "попа", "попка"}
-
-					for _, command := range cmds {
-						cmdLen := len(command)
-						if cmd[:cmdLen] == command {
-							done = true
-							outgoingMessage = msg
-
-							break
-						}
-					}
+					return
 				}
 
-				if !done {
-					value = getSetting(channel, "oboobs")
-
-					if value == "1" {
-						cmds := []string{"tits", "boobs", "tities", "boobies", "сиси", "сисечки"}
-
-						for _, command := range cmds {
-							cmdLen := len(command)
-							if cmd[:cmdLen] == command {
-								// done = true
-								outgoingMessage = msg
-
-								break
-							}
-						}
-					}
-				}
+				// Проставляем правильный в конкретно данном случае username, так как отвечать мы будем ему
+				message.Misc.Username = args
+				outgoingMessage = msg
+			case args == "":
+				// Команда без аргументов, а для nick - тихо сам с собою я веду беседу...
+				outgoingMessage = msg
 			}
 		}
 
 		if outgoingMessage != "" {
 			message.Message = outgoingMessage
-			data, err := json.Marshal(message)
-
-			if err != nil {
-				log.Warnf("Unable to to serialize message for redis: %s", err)
-
-				return
-			}
-
-			// Заталкиваем наш json в редиску
-			if err := redisClient.Publish(ctx, config.Redis.Channel, data).Err(); err != nil {
-				log.Warnf("Unable to send data to redis channel %s: %s", config.Redis.Channel, err)
-			} else {
-				log.Debugf("Sent msg to redis channel %s: %s", config.Redis.Channel, string(data))
+			// Заталкиваем наше сообщение в шину
+			if err := bus.Publish(ctx, message); err != nil {
+				log.Warn(err)
 			}
 		}
 	} else {
 		// Это уже просто трёп в чятике
 		var message sMsg
+		message.Version = msgSchemaVersion
 		message.From = config.Redis.MyChannel
 		message.Userid = user    // как его видит сервер
 		message.Chatid = channel // чятик, в который написал user
 		message.Threadid = ""    // тредиков в irc нету, поэтому это поле отправляем пустым
 		message.Message = msg
 		message.Plugin = config.Redis.MyChannel
-		message.Mode = "public"
+		message.Mode = mode
 
 		// Если во фразе содержится ключевые слова, под это есть костыль в craniac-е - (предполагаем, что) он
 		// знает ставить или не ставить флажок answer
 		message.Misc.Answer = 0
 
-		// Предполагается что в канале бот должен отвечать, только если к нему обратились, либо это была команда
-		if regexp.MustCompile(ircClient.GetNick()).Match([]byte(message.Message)) {
+		// Предполагается что в канале бот должен отвечать, только если к нему обратились, либо это была команда, а в
+		// привате к нему обращаются всегда
+		// Ник сравниваем без учёта регистра по правилам сервера, в нём бывают символы вроде [] и |, поэтому не regexp
+		addressed := strings.Contains(isupport.Casefold(message.Message), isupport.Casefold(ircClient.GetNick()))
+		if mode == "private" || addressed {
 			message.Misc.Answer = 1
 		}
 
@@ -349,79 +219,41 @@ func ircMsgParser(channel string, nick string, user string, source string, msg s
 			}
 		}
 
-		message.Misc.Fwdcnt = 0
-		message.Misc.Csign = config.Csign
+		// На NOTICE-ы по правилам IRC отвечать не принято, иначе два бота могут зациклиться
+		if kind == msgKindNotice {
+			message.Misc.Answer = 0
+		}
+
+		message.Misc.Fwdcnt = fwdcnt
+		message.Misc.Csign = csign
 		message.Misc.Username = nick
 		message.Misc.Botnick = config.Irc.Nick
 		message.Misc.Msgformat = 0
+		message.Misc.Account = tagAccount(tags)
+		message.Misc.ServerTime = tagServerTime(tags).Format(time.RFC3339Nano)
+		message.Misc.MsgType = string(kind)
 
-		data, err := json.Marshal(message)
-
-		if err != nil {
-			log.Warnf("Unable to to serialize message for redis: %s", err)
-
-			return
-		}
-
-		// Заталкиваем наш json в редиску
-		if err := redisClient.Publish(ctx, config.Redis.Channel, data).Err(); err != nil {
-			log.Warnf("Unable to send data to redis channel %s: %s", config.Redis.Channel, err)
-		} else {
-			log.Debugf("Sent msg to redis channel %s: %s", config.Redis.Channel, string(data))
+		// Заталкиваем наше сообщение в шину
+		if err := bus.Publish(ctx, message); err != nil {
+			log.Warn(err)
 		}
 	}
 }
 
-// redisMsgParser парсит json-чики прилетевшие из REDIS-ки, причём, json-чики должны быть относительно валидными.
-func redisMsgParser(msg string) {
-	if shutdown {
-		// Если мы завершаем работу программы, то нам ничего обрабатывать не надо
-		return
-	}
-
-	var j rMsg
-
-	log.Debugf("Incoming raw json: %s", msg)
-
-	if err := json.Unmarshal([]byte(msg), &j); err != nil {
-		log.Warnf("Unable to to parse message from redis channel: %s", err)
-
-		return
-	}
-
-	// Validate our j
-	if exist := j.From; exist == "" {
-		log.Warnf("Incorrect msg from redis, no from field: %s", msg)
-
-		return
-	}
-
-	if exist := j.Chatid; exist == "" {
-		log.Warnf("Incorrect msg from redis, no chatid field: %s", msg)
-
-		return
-	}
-
-	if exist := j.Userid; exist == "" {
-		log.Warnf("Incorrect msg from redis, no userid field: %s", msg)
-
-		return
-	}
-
-	if exist := j.Message; exist == "" {
-		log.Warnf("Incorrect msg from redis, no message field: %s", msg)
-
-		return
-	}
-
-	if exist := j.Plugin; exist == "" {
-		log.Warnf("Incorrect msg from redis, no plugin field: %s", msg)
+// busMsgParser разбирает сообщения, прилетевшие из шины, причём, сообщения должны быть относительно валидными.
+func busMsgParser(j rMsg) {
+	config := currentConfig()
 
+	if shuttingDown() {
+		// Если мы завершаем работу программы, то нам ничего обрабатывать не надо
 		return
 	}
 
-	if exist := j.Mode; exist == "" {
-		log.Warnf("Incorrect msg from redis, no mode field: %s", msg)
+	// Validate our j, см. msg-schema.go
+	if err := validateRMsg(j); err != nil {
+		// Исходный json-чик остался в шине, для лога и nack-а соберём его заново
+		data, _ := json.Marshal(j)
+		rejectMsg(j.From, j.Chatid, string(data), err)
 
 		return
 	}
@@ -439,23 +271,48 @@ func redisMsgParser(msg string) {
 		j.Misc.Csign = config.Csign
 	}
 
-	// j.Misc.FwdCnt если нам его не передали, то будет 0
-	if exist := j.Misc.Fwdcnt; exist == 0 {
-		j.Misc.Fwdcnt = 1
+	// j.Misc.FwdCnt если нам его не передали, то будет 0. Отправка в IRC - это ещё одна пересылка, так что счётчик
+	// увеличиваем и проверяем уже увеличенный
+	j.Misc.Fwdcnt++
+
+	// Сообщение, пересланное слишком много раз, скорее всего, гуляет по кругу между ботами
+	if !forwardAllowed("incoming", j.Misc.Fwdcnt) {
+		log.Warnf("Dropping msg to %s, it has been forwarded %d times, forwards_max is %d",
+			j.Chatid, j.Misc.Fwdcnt, config.ForwardsMax)
+
+		return
 	}
 
 	// j.Misc.GoodMorning может быть быть 1 или 0, по-умолчанию 0
 	// j.Misc.MsgFormat может быть быть 1 или 0, по-умолчанию 0
 	// j.Misc.Username можно не передавать, тогда будет пустая строка
 
+	// j.Misc.MsgType можно не передавать, тогда это обычное сообщение.
+	kind := msgKind(j.Misc.MsgType)
+
+	if kind == "" {
+		kind = msgKindPrivmsg
+
+		// Старые версии сервисов присылают действия как текст, начинающийся с "/me ".
+		if strings.HasPrefix(j.Message, "/me ") {
+			kind = msgKindAction
+			j.Message = j.Message[len("/me "):]
+		}
+	}
+
 	// Отвалидировались, теперь вернёмся к нашим баранам.
-	lines := regexp.MustCompile("\r?\n").Split(j.Message, -1)
+	lines := busLineSeparator.Split(j.Message, -1)
+
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
 
-	for _, message := range lines {
-		if userModeIsOped(j.Chatid, ircClient.GetNick()) || userModeIsVoiced(j.Chatid, ircClient.GetNick()) {
-			imChanUnrestricted <- iMsg{ChatID: j.Chatid, Text: message}
-		} else {
-			imChan <- iMsg{ChatID: j.Chatid, Text: message}
+		// Режем строку на куски, влезающие в лимит длины строки сервера, каждый кусок уходит отдельным сообщением и
+		// отдельно учитывается ограничителем скорости.
+		for _, message := range ircSplitMsg(iMsg{ChatID: j.Chatid, Text: line, Kind: kind}) {
+			forwardEchoes.Remember(message.Text, j.Misc.Fwdcnt, time.Now())
+			sender.Enqueue(message)
 		}
 	}
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* Схема сообщений, которыми мы обмениваемся с роутером через шину. Сообщение - это json-объект с полями from, chatid,
+ * userid, threadid, message, plugin, mode и вложенным объектом misc. Начиная со второй версии схемы у сообщения есть
+ * поле version, и такие сообщения разбираются строго: неизвестное поле или поле не того типа - это ошибка. Сообщения
+ * без version - это первая версия схемы от старых отправителей, в них неизвестные поля только пишутся в лог. Старые
+ * отправители называют вложенный объект Misc, а не misc, json в go сравнивает имена полей без учёта регистра, так что
+ * подходят оба варианта.
+ *
+ * Если в конфиге включен redis.nack, то на отвергнутое сообщение мы отвечаем в канал из его поля from сообщением
+ * nMsg с типом nack, описанием ошибки и исходным сообщением. Сами nack-и мы никогда не отвергаем, чтобы два сервиса не
+ * отвечали друг другу ошибками до бесконечности.
+ */
+
+const (
+	// Версия схемы, которую мы отправляем и до которой включительно умеем принимать.
+	msgSchemaVersion = 2
+	// Версия схемы сообщений без поля version.
+	msgSchemaLegacy = 1
+	// Тип сообщения об ошибке.
+	nackType = "nack"
+)
+
+// Получено сообщение об ошибке, а не обычное сообщение.
+var errNackReceived = errors.New("nack received")
+
+// Сообщение об ошибке, которое мы отправляем в ответ на отвергнутое сообщение.
+type nMsg struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	From    string `json:"from"`
+	Chatid  string `json:"chatid,omitempty"`
+	Error   string `json:"error"`
+	// Исходное сообщение как есть, оно может оказаться и не json-ом.
+	Message string `json:"message"`
+}
+
+// msgEnvelope - это поля сообщения, по которым понятно, что это за сообщение, ещё до его разбора.
+type msgEnvelope struct {
+	Type  string `json:"type"`
+	From  string `json:"from"`
+	Error string `json:"error"`
+}
+
+// decodeRMsg разбирает json-чик из шины согласно его версии схемы.
+func decodeRMsg(payload []byte) (rMsg, error) {
+	var envelope msgEnvelope
+
+	// Ошибки типов тут не важны, их найдёт разбор ниже
+	_ = json.Unmarshal(payload, &envelope)
+
+	if envelope.Type == nackType {
+		return rMsg{From: envelope.From}, fmt.Errorf("%w from %s: %s", errNackReceived, envelope.From, envelope.Error)
+	}
+
+	var msg rMsg
+
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return msg, schemaError(err)
+	}
+
+	switch {
+	case msg.Version == 0:
+		msg.Version = msgSchemaLegacy
+	case msg.Version < 0 || msg.Version > msgSchemaVersion:
+		return msg, fmt.Errorf("unsupported schema version %d, supported versions are %d to %d",
+			msg.Version, msgSchemaLegacy, msgSchemaVersion)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&rMsg{}); err != nil {
+		if msg.Version >= msgSchemaVersion {
+			return msg, schemaError(err)
+		}
+
+		log.Warnf("Msg from %s without schema version: %s", msg.From, schemaError(err))
+	}
+
+	return msg, nil
+}
+
+// schemaError переводит ошибку разбора json-а в понятное отправителю описание.
+func schemaError(err error) error {
+	var typeError *json.UnmarshalTypeError
+
+	var syntaxError *json.SyntaxError
+
+	switch {
+	case errors.As(err, &typeError):
+		return fmt.Errorf("field %s must be %s, not %s", typeError.Field, typeError.Type, typeError.Value)
+	case errors.As(err, &syntaxError):
+		return fmt.Errorf("invalid json at offset %d: %w", syntaxError.Offset, err)
+	}
+
+	// Для неизвестных полей у encoding/json нет отдельного типа ошибки
+	return errors.New(strings.TrimPrefix(err.Error(), "json: "))
+}
+
+// validateRMsg проверяет, что в сообщении из шины есть все обязательные поля и их значения осмысленны.
+func validateRMsg(msg rMsg) error {
+	var problems []error
+
+	required := []struct {
+		field string
+		value string
+	}{
+		{"from", msg.From},
+		{"chatid", msg.Chatid},
+		{"userid", msg.Userid},
+		{"message", msg.Message},
+		{"plugin", msg.Plugin},
+		{"mode", msg.Mode},
+	}
+
+	for _, r := range required {
+		if r.value == "" {
+			problems = append(problems, fmt.Errorf("no %s field", r.field))
+		}
+	}
+
+	if msg.Misc.Fwdcnt < 0 {
+		problems = append(problems, errors.New("misc.fwd_cnt must not be negative"))
+	}
+
+	switch msgKind(msg.Misc.MsgType) {
+	case "", msgKindPrivmsg, msgKindAction, msgKindNotice, msgKindCtcpReply:
+	default:
+		problems = append(problems, fmt.Errorf("unknown misc.msg_type %q", msg.Misc.MsgType))
+	}
+
+	return errors.Join(problems...)
+}
+
+// rejectMsg пишет в лог об отвергнутом сообщении и, если это включено в конфиге, отвечает отправителю сообщением об
+// ошибке.
+func rejectMsg(from string, chatid string, payload string, reason error) {
+	config := currentConfig()
+
+	// errors.Join разделяет ошибки переводом строки, а в логе и nack-е нужна одна строка
+	text := strings.ReplaceAll(reason.Error(), "\n", "; ")
+
+	log.Warnf("Rejecting msg from %s: %s: %s", from, text, payload)
+
+	// Отвечать некому или ответ придёт нам же
+	if !config.Redis.Nack || from == "" || from == config.Redis.MyChannel {
+		return
+	}
+
+	nack := nMsg{
+		Version: msgSchemaVersion,
+		Type:    nackType,
+		From:    config.Redis.MyChannel,
+		Chatid:  chatid,
+		Error:   text,
+		Message: payload,
+	}
+
+	if err := bus.Nack(ctx, from, nack); err != nil {
+		log.Warnf("Unable to send nack to %s: %s", from, err)
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
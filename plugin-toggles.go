@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* Отключаемые плагины. Операторы канала включают и выключают их командой !admin, состояние хранится в базе настроек
+ * канала (см. settings-db-util.go) под именем плагина: "1" - включен, "0" - выключен. Команды плагина работают только
+ * на канале и только если плагин на нём включен. Чтобы добавить новый отключаемый плагин, достаточно дописать его в
+ * toggleFeatures, а его командам в реестре команд указать toggle, см. command-registry.go.
+ */
+
+// toggleFeature - это плагин, который можно включать и выключать на канале.
+type toggleFeature struct {
+	Name        string
+	Description string
+	// Включен ли плагин на канале, где его ещё ни разу не включали и не выключали.
+	Default bool
+}
+
+// Отключаемые плагины.
+var toggleFeatures = []toggleFeature{
+	{
+		Name:        "oboobs",
+		Description: "показываем ли сисечки по просьбе участников чата",
+	},
+	{
+		Name:        "obutts",
+		Description: "показываем ли попки по просьбе участников чата",
+	},
+}
+
+// findToggle ищет отключаемый плагин по имени.
+func findToggle(name string) (toggleFeature, bool) {
+	for _, feature := range toggleFeatures {
+		if strings.EqualFold(feature.Name, name) {
+			return feature, true
+		}
+	}
+
+	return toggleFeature{}, false
+}
+
+// toggleEnabled проверяет, включен ли плагин на канале.
+func toggleEnabled(channel string, feature toggleFeature) bool {
+	switch getSetting(channel, feature.Name) {
+	case "1":
+		return true
+	case "0":
+		return false
+	default:
+		return feature.Default
+	}
+}
+
+// toggleState возвращает состояние плагина для ответа пользователю.
+func toggleState(enabled bool) string {
+	if enabled {
+		return "включен"
+	}
+
+	return "выключен"
+}
+
+// adminCommand выполняет команду !admin с аргументами args на канале channel и отвечает пользователю caller с ролью
+// role в приват. Права на команду см. в irc-acl.go.
+func adminCommand(channel string, caller aclCaller, role aclRole, csign string, args string) {
+	reply := func(format string, a ...interface{}) {
+		sender.Enqueue(iMsg{ChatID: caller.Nick, Text: fmt.Sprintf(format, a...)})
+	}
+
+	fields := strings.Fields(args)
+
+	if len(fields) == 0 {
+		reply("%sadmin list                 - отключаемые плагины, их состояние на канале и доверенные участники", csign)
+		reply("%sadmin <плагин> on|off      - включить или выключить плагин", csign)
+		reply("%sadmin <плагин> [status]    - включен ли плагин", csign)
+
+		if role >= roleAdmin {
+			reply("%sadmin trust <ник|маска> [trusted|admin] - добавить доверенного участника или админа канала", csign)
+			reply("%sadmin untrust <ник|маска> - удалить доверенного участника или админа канала", csign)
+		}
+
+		for _, feature := range toggleFeatures {
+			reply("%sadmin %s - %s (команды %s%s)", csign, feature.Name, feature.Description, csign,
+				strings.Join(botCommands.Toggled(feature.Name), ", "+csign))
+		}
+
+		return
+	}
+
+	switch fields[0] {
+	case "list":
+		for _, feature := range toggleFeatures {
+			reply("%s: %s - %s", feature.Name, toggleState(toggleEnabled(channel, feature)), feature.Description)
+		}
+
+		for _, line := range aclList(channel) {
+			reply("%s", line)
+		}
+
+		return
+	case "trust", "untrust":
+		reply("%s", aclCommand(channel, caller, role, fields[0], fields[1:]))
+
+		return
+	}
+
+	feature, ok := findToggle(fields[0])
+
+	if !ok || len(fields) > 2 {
+		reply("Нет такого плагина или команды, см. %sadmin", csign)
+
+		return
+	}
+
+	action := "status"
+
+	if len(fields) == 2 {
+		action = strings.ToLower(fields[1])
+	}
+
+	var value string
+
+	// 1 и 0 - это старый синтаксис, от него не отказываемся
+	switch action {
+	case "status":
+		reply("Плагин %s %s", feature.Name, toggleState(toggleEnabled(channel, feature)))
+
+		return
+	case "on", "1":
+		value = "1"
+	case "off", "0":
+		value = "0"
+	default:
+		reply("Не понимаю %s, плагин можно включить (on) или выключить (off)", fields[1])
+
+		return
+	}
+
+	if err := saveSetting(channel, feature.Name, value); err != nil {
+		log.Errorf("Unable to save %s setting for %s: %s", feature.Name, channel, err)
+		reply("Плагин %s всё ещё %s", feature.Name, toggleState(toggleEnabled(channel, feature)))
+
+		return
+	}
+
+	log.Infof("%s set plugin %s to %s on %s", caller.Source, feature.Name, value, channel)
+	reply("Плагин %s %s", feature.Name, toggleState(value == "1"))
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+)
+
+/* Клиент redis-ки. Redis может быть как одиночным сервером, так и мастером под присмотром sentinel-ов, в последнем
+ * случае адрес текущего мастера клиент узнаёт у sentinel-ов сам и после failover-а переподключается к новому мастеру.
+ * Подписка на pubsub-канал переподключается вместе с ним, а если go-redis всё же закроет подписку, то redisBus
+ * подпишется заново. Вместо pubsub-а для каждого направления можно использовать стримы, см. redis-streams.go.
+ */
+
+// newRedisClient создаёт клиента redis-ки согласно конфигу.
+func newRedisClient() (*redis.Client, error) {
+	config := currentConfig()
+
+	var tlsConfig *tls.Config
+
+	if config.Redis.Tls.Enabled {
+		var err error
+
+		if tlsConfig, err = redisTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	dialTimeout := time.Duration(config.Redis.DialTimeout) * time.Second
+	readTimeout := time.Duration(config.Redis.ReadTimeout) * time.Second
+
+	if config.Redis.Sentinel.MasterName != "" {
+		log.Debugf("Using redis master %s from sentinels %v", config.Redis.Sentinel.MasterName, config.Redis.Sentinel.Addrs)
+
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       config.Redis.Sentinel.MasterName,
+			SentinelAddrs:    config.Redis.Sentinel.Addrs,
+			SentinelUsername: config.Redis.Sentinel.Username,
+			SentinelPassword: config.Redis.Sentinel.Password,
+			Username:         config.Redis.Username,
+			Password:         config.Redis.Password,
+			DB:               config.Redis.Database,
+			DialTimeout:      dialTimeout,
+			ReadTimeout:      readTimeout,
+			TLSConfig:        tlsConfig,
+		}), nil
+	}
+
+	log.Debugf("Lazy connect() to redis at %s:%d", config.Redis.Server, config.Redis.Port)
+
+	return redis.NewClient(&redis.Options{
+		Addr:        fmt.Sprintf("%s:%d", config.Redis.Server, config.Redis.Port),
+		Username:    config.Redis.Username,
+		Password:    config.Redis.Password,
+		DB:          config.Redis.Database,
+		DialTimeout: dialTimeout,
+		ReadTimeout: readTimeout,
+		TLSConfig:   tlsConfig,
+	}), nil
+}
+
+// redisTLSConfig собирает настройки TLS для соединения с redis-кой, вызывается, только если TLS включен.
+func redisTLSConfig() (*tls.Config, error) {
+	config := currentConfig()
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: config.Redis.Tls.SkipVerify, //nolint: gosec
+	}
+
+	if config.Redis.Tls.CaFile != "" {
+		ca, err := os.ReadFile(config.Redis.Tls.CaFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to read redis CA file: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in redis CA file %s", config.Redis.Tls.CaFile)
+		}
+	}
+
+	if config.Redis.Tls.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.Redis.Tls.CertFile, config.Redis.Tls.KeyFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to load redis client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// redisBus - это шина сообщений поверх redis-ки: pubsub или стримы, в зависимости от настроек каждого направления.
+type redisBus struct {
+	client *redis.Client
+}
+
+// newRedisBus создаёт шину сообщений поверх redis-ки согласно конфигу.
+func newRedisBus() (*redisBus, error) {
+	client, err := newRedisClient()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &redisBus{client: client}, nil
+}
+
+// Publish отправляет сообщение в канал роутера.
+func (b *redisBus) Publish(ctx context.Context, msg sMsg) error {
+	config := currentConfig()
+
+	data, err := json.Marshal(msg)
+
+	if err != nil {
+		return fmt.Errorf("unable to serialize message for redis: %w", err)
+	}
+
+	return b.send(ctx, config.Redis.Channel, data)
+}
+
+// Nack отправляет сообщение об ошибке в канал to.
+func (b *redisBus) Nack(ctx context.Context, to string, nack nMsg) error {
+	data, err := json.Marshal(nack)
+
+	if err != nil {
+		return fmt.Errorf("unable to serialize nack for redis: %w", err)
+	}
+
+	return b.send(ctx, to, data)
+}
+
+// send отправляет json-чик в канал channel тем способом, который задан в конфиге для исходящих сообщений.
+func (b *redisBus) send(ctx context.Context, channel string, data []byte) error {
+	config := currentConfig()
+
+	var err error
+
+	if config.Redis.Transport.Outgoing == transportStreams {
+		err = b.streamPublish(ctx, channel, data)
+	} else {
+		err = b.client.Publish(ctx, channel, data).Err()
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to send data to redis channel %s: %w", channel, err)
+	}
+
+	log.Debugf("Sent msg to redis channel %s: %s", channel, string(data))
+
+	return nil
+}
+
+// Subscribe разбирает сообщения для нас, прилетающие через redis-ку, пока не отменён ctx.
+func (b *redisBus) Subscribe(ctx context.Context, handler func(rMsg)) {
+	config := currentConfig()
+
+	if config.Redis.Transport.Incoming == transportStreams {
+		b.streamReceive(ctx, handler)
+
+		return
+	}
+
+	b.subscribe(ctx, handler)
+}
+
+// Commands читает объявления команд из хэша redis.registry.key.
+func (b *redisBus) Commands(ctx context.Context) (map[string]string, error) {
+	config := currentConfig()
+
+	announcements, err := b.client.HGetAll(ctx, config.Redis.Registry.Key).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to read command registry %s: %w", config.Redis.Registry.Key, err)
+	}
+
+	return announcements, nil
+}
+
+// Health проверяет, что redis-ка отвечает.
+func (b *redisBus) Health(ctx context.Context) error {
+	return b.client.Ping(ctx).Err()
+}
+
+// Close закрывает соединения с redis-кой.
+func (b *redisBus) Close() error {
+	return b.client.Close()
+}
+
+// deliver разбирает json-чик, прилетевший из redis-ки, и передаёт сообщение обработчику.
+func (b *redisBus) deliver(payload string, handler func(rMsg)) {
+	log.Debugf("Incoming raw json: %s", payload)
+
+	msg, err := decodeRMsg([]byte(payload))
+
+	switch {
+	case errors.Is(err, errNackReceived):
+		log.Warn(err)
+
+		return
+	case err != nil:
+		rejectMsg(msg.From, msg.Chatid, payload, err)
+
+		return
+	}
+
+	handler(msg)
+}
+
+// subscribe подписывается на наш pubsub-канал и разбирает прилетающие в него сообщения, пока не отменён ctx.
+func (b *redisBus) subscribe(ctx context.Context, handler func(rMsg)) {
+	config := currentConfig()
+
+	for ctx.Err() == nil {
+		subscriber := b.client.Subscribe(ctx, config.Redis.MyChannel)
+		messages := subscriber.Channel()
+		closed := false
+
+		for !closed {
+			select {
+			case <-ctx.Done():
+				closed = true
+			case msg, ok := <-messages:
+				if !ok {
+					closed = true
+
+					break
+				}
+
+				b.deliver(msg.Payload, handler)
+			}
+		}
+
+		if ctx.Err() != nil {
+			// Отпишемся, чтобы к нам больше не прилетали новые сообщения, основной контекст уже отменён, поэтому нужен
+			// свой
+			if err := subscriber.Unsubscribe(context.Background()); err != nil {
+				log.Errorf("Unable to unsubscribe from redis channels cleanly: %s", err)
+			} else {
+				log.Debug("Unsubscribe from all redis channels")
+			}
+
+			if err := subscriber.Close(); err != nil {
+				log.Errorf("Unable to close redis subscription cleanly: %s", err)
+			}
+
+			return
+		}
+
+		// Подписку закрыли не мы, подпишемся заново
+		log.Warnf("Redis subscription to %s is closed, resubscribing", config.Redis.MyChannel)
+		_ = subscriber.Close()
+
+		if !sleep(ctx, time.Second) {
+			return
+		}
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+)
+
+/* Доставка сообщений через Redis Streams. В отличие от pubsub-а, сообщения в стриме не пропадают, пока нас нет:
+ * входящие мы читаем в consumer group и подтверждаем (XACK) только после того, как разобрали, а исходящие лежат в
+ * стриме, пока их не заберёт роутер. Формат сообщений тот же, что и в pubsub-е, json лежит в поле data записи стрима.
+ * Стримы называются так же, как и pubsub-каналы: входящий - my_channel, исходящий - channel.
+ *
+ * При старте сначала дочитываются сообщения, которые мы взяли, но не успели подтвердить в прошлый раз, затем забираются
+ * себе сообщения, зависшие у других consumer-ов группы дольше claim_idle секунд, и только потом читаются новые.
+ */
+
+const (
+	transportPubsub  = "pubsub"
+	transportStreams = "streams"
+
+	defaultStreamGroup     = "aleesa-irc-go"
+	defaultStreamMaxLen    = 10000
+	defaultStreamClaimIdle = 60
+
+	// Поле записи стрима, в котором лежит json сообщения.
+	streamDataField = "data"
+	// Сколько сообщений читать из стрима за раз.
+	streamReadCount = 10
+	// Сколько ждать новых сообщений в одном XREADGROUP.
+	streamReadBlock = 5 * time.Second
+)
+
+// streamReceive читает входящий стрим в consumer group, пока не отменён ctx.
+func (b *redisBus) streamReceive(ctx context.Context, handler func(rMsg)) {
+	config := currentConfig()
+
+	stream := config.Redis.MyChannel
+	group := config.Redis.Streams.Group
+	consumer := config.Redis.Streams.Consumer
+
+	log.Infof("Reading redis stream %s as %s in group %s", stream, consumer, group)
+
+	for ctx.Err() == nil {
+		err := b.streamSetup(ctx, stream, group, consumer, handler)
+
+		if err == nil {
+			err = b.streamConsume(ctx, stream, group, consumer, ">", handler)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Warnf("Unable to read redis stream %s: %s", stream, err)
+
+		if !sleep(ctx, time.Second) {
+			return
+		}
+	}
+}
+
+// streamSetup создаёт consumer group, если её ещё нет, и разбирает сообщения, которые зависли неподтверждёнными.
+func (b *redisBus) streamSetup(ctx context.Context, stream, group, consumer string, handler func(rMsg)) error {
+	// Группа читает только те сообщения, которые пришли после её создания
+	err := b.client.XGroupCreateMkStream(ctx, stream, group, "$").Err()
+
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	// Свои неподтверждённые сообщения, с id 0 XREADGROUP отдаёт именно их
+	if err := b.streamConsume(ctx, stream, group, consumer, "0", handler); err != nil {
+		return err
+	}
+
+	// Чужие зависшие сообщения, например, от инстанса, который умер и больше не поднимется. XAUTOCLAIM тут не годится:
+	// go-redis не понимает ответ на него от redis 7, в котором три элемента, а не два
+	return b.streamClaim(ctx, stream, group, consumer, handler)
+}
+
+// streamClaim забирает себе и разбирает сообщения, которые висят неподтверждёнными у других consumer-ов группы дольше
+// claim_idle секунд. Список зависших сообщений берём из XPENDING, а забираем их XCLAIM-ом, который ещё раз проверяет
+// idle, так что сообщение, которое кто-то успел взять в работу, не уведём.
+func (b *redisBus) streamClaim(ctx context.Context, stream, group, consumer string, handler func(rMsg)) error {
+	config := currentConfig()
+
+	minIdle := time.Duration(config.Redis.Streams.ClaimIdle) * time.Second
+	start := "-"
+
+	for {
+		pending, err := b.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: stream,
+			Group:  group,
+			Start:  start,
+			End:    "+",
+			Count:  streamReadCount,
+		}).Result()
+
+		if err != nil {
+			log.Warnf("Unable to list pending messages in redis stream %s: %s", stream, err)
+
+			return nil
+		}
+
+		var ids []string
+
+		// Свои неподтверждённые сообщения мы уже дочитали
+		for _, message := range pending {
+			if message.Consumer != consumer && message.Idle >= minIdle {
+				ids = append(ids, message.ID)
+			}
+		}
+
+		if len(ids) > 0 {
+			messages, err := b.client.XClaim(ctx, &redis.XClaimArgs{
+				Stream:   stream,
+				Group:    group,
+				Consumer: consumer,
+				MinIdle:  minIdle,
+				Messages: ids,
+			}).Result()
+
+			if err != nil {
+				log.Warnf("Unable to claim pending messages from redis stream %s: %s", stream, err)
+
+				return nil
+			}
+
+			if len(messages) > 0 {
+				log.Infof("Claimed %d pending messages from redis stream %s", len(messages), stream)
+			}
+
+			if !b.streamProcess(ctx, stream, group, messages, handler) {
+				return ctx.Err()
+			}
+		}
+
+		if len(pending) < streamReadCount {
+			return nil
+		}
+
+		// Следующую пачку смотрим после последнего просмотренного сообщения
+		if start = nextStreamID(pending[len(pending)-1].ID); start == "" {
+			return nil
+		}
+	}
+}
+
+// nextStreamID возвращает id, следующий за id записи стрима, или пустую строку, если id неправильный. Исключающие
+// диапазоны вида (id в XPENDING есть только с redis 6.2, поэтому следующий id считаем сами.
+func nextStreamID(id string) string {
+	ms, seq, ok := strings.Cut(id, "-")
+
+	if !ok {
+		return ""
+	}
+
+	n, err := strconv.ParseUint(seq, 10, 64)
+
+	if err != nil {
+		return ""
+	}
+
+	return ms + "-" + strconv.FormatUint(n+1, 10)
+}
+
+// streamConsume читает сообщения из стрима начиная с id. Для id ">" читаются новые сообщения, пока не отменён ctx
+// или не случилась ошибка, для остальных id - пока не закончатся неподтверждённые.
+func (b *redisBus) streamConsume(ctx context.Context, stream, group, consumer, id string, handler func(rMsg)) error {
+	for {
+		args := &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: consumer,
+			Streams:  []string{stream, id},
+			Count:    streamReadCount,
+			Block:    streamReadBlock,
+		}
+
+		// Неподтверждённые сообщения отдаются сразу, ждать их не надо
+		if id != ">" {
+			args.Block = -1
+		}
+
+		streams, err := b.client.XReadGroup(ctx, args).Result()
+
+		switch {
+		case errors.Is(err, redis.Nil) && id == ">":
+			continue
+		case errors.Is(err, redis.Nil):
+			return nil
+		case err != nil:
+			return err
+		}
+
+		var messages []redis.XMessage
+
+		for _, s := range streams {
+			messages = append(messages, s.Messages...)
+		}
+
+		if !b.streamProcess(ctx, stream, group, messages, handler) {
+			return ctx.Err()
+		}
+
+		if id == ">" {
+			continue
+		}
+
+		if len(messages) == 0 {
+			return nil
+		}
+
+		// Следующую пачку неподтверждённых сообщений читаем после последнего разобранного
+		id = messages[len(messages)-1].ID
+	}
+}
+
+// streamProcess разбирает сообщения из стрима и подтверждает их. Возвращает false, если мы выключаемся, тогда
+// оставшиеся сообщения не подтверждаются и будут разобраны после рестарта.
+func (b *redisBus) streamProcess(
+	ctx context.Context, stream, group string, messages []redis.XMessage, handler func(rMsg),
+) bool {
+	for _, message := range messages {
+		if shuttingDown() {
+			return false
+		}
+
+		if data, ok := message.Values[streamDataField].(string); ok {
+			b.deliver(data, handler)
+		} else {
+			// Такое сообщение разобрать не выйдет никогда, поэтому подтверждаем его, чтобы оно не висело вечно
+			log.Warnf("Incorrect msg %s from redis stream %s, no %s field", message.ID, stream, streamDataField)
+		}
+
+		if err := b.client.XAck(ctx, stream, group, message.ID).Err(); err != nil {
+			log.Warnf("Unable to ack msg %s in redis stream %s: %s", message.ID, stream, err)
+		}
+	}
+
+	return true
+}
+
+// streamPublish добавляет сообщение в исходящий стрим, выкидывая из него старые сообщения сверх max_len.
+func (b *redisBus) streamPublish(ctx context.Context, stream string, data []byte) error {
+	config := currentConfig()
+
+	return b.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: config.Redis.Streams.MaxLen,
+		Approx: true,
+		Values: map[string]interface{}{streamDataField: data},
+	}).Err()
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
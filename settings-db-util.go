@@ -44,6 +44,8 @@ func FetchV(db *pebble.DB, key string) (string, error) {
 
 // Достанем настройку из БД с настройками.
 func getSetting(chatID string, setting string) string {
+	config := currentConfig()
+
 	var err error
 
 	chatHash := sha256.Sum256([]byte(chatID))
@@ -88,6 +90,8 @@ func getSetting(chatID string, setting string) string {
 
 // Сохраним настройку в БД с настройками.
 func saveSetting(chatID string, setting string, value string) error {
+	config := currentConfig()
+
 	var chatHash = sha256.Sum256([]byte(chatID))
 
 	var database = fmt.Sprintf("settings_db/%x", chatHash)
@@ -7,18 +7,80 @@ type myConfig struct {
 		Port      int    `json:"port,omitempty"`
 		Channel   string `json:"channel,omitempty"`
 		MyChannel string `json:"my_channel,omitempty"`
+		// Авторизация в redis-ке, пароль можно взять из переменной окружения или файла, см. config-secrets.go.
+		Username     string `json:"username,omitempty"`
+		Password     string `json:"password,omitempty"`
+		PasswordEnv  string `json:"password_env,omitempty"`
+		PasswordFile string `json:"password_file,omitempty"`
+		// Номер базы redis-ки, на pubsub он не влияет, но влияет на ACL.
+		Database int `json:"database,omitempty"`
+		// Отвечать ли отправителю сообщением об ошибке, если его сообщение не прошло проверку схемы.
+		Nack bool `json:"nack,omitempty"`
+		Tls  struct {
+			Enabled bool `json:"enabled,omitempty"`
+			// CA, которым подписан сертификат сервера, если не задан, то используются системные CA.
+			CaFile string `json:"ca_file,omitempty"`
+			// Клиентский сертификат и ключ, если сервер требует mTLS.
+			CertFile string `json:"cert_file,omitempty"`
+			KeyFile  string `json:"key_file,omitempty"`
+			// Не проверять сертификат сервера.
+			SkipVerify bool `json:"skip_verify,omitempty"`
+		} `json:"tls,omitempty"`
+		// Если задан master_name, то адрес мастера узнаётся у sentinel-ов, а server и port не используются.
+		Sentinel struct {
+			MasterName   string   `json:"master_name,omitempty"`
+			Addrs        []string `json:"addrs,omitempty"`
+			Username     string   `json:"username,omitempty"`
+			Password     string   `json:"password,omitempty"`
+			PasswordEnv  string   `json:"password_env,omitempty"`
+			PasswordFile string   `json:"password_file,omitempty"`
+		} `json:"sentinel,omitempty"`
+		// Таймауты на установку соединения и чтение ответа в секундах.
+		DialTimeout int `json:"dial_timeout,omitempty"`
+		ReadTimeout int `json:"read_timeout,omitempty"`
+		// Способ доставки сообщений в каждую сторону: pubsub или streams, см. redis-streams.go.
+		Transport struct {
+			// Сообщения для нас, читаются из my_channel.
+			Incoming string `json:"incoming,omitempty"`
+			// Сообщения от нас, пишутся в channel.
+			Outgoing string `json:"outgoing,omitempty"`
+		} `json:"transport,omitempty"`
+		Streams struct {
+			// Consumer group, в которой мы читаем входящий стрим, и наше имя в ней.
+			Group    string `json:"group,omitempty"`
+			Consumer string `json:"consumer,omitempty"`
+			// Примерная максимальная длина исходящего стрима, старые сообщения из него выкидываются.
+			MaxLen int64 `json:"max_len,omitempty"`
+			// Через сколько секунд неподтверждённое сообщение другого consumer-а из группы забирается себе.
+			ClaimIdle int `json:"claim_idle,omitempty"`
+		} `json:"streams,omitempty"`
+		// Хэш, в котором сервисы бота объявляют свои команды, см. command-discovery.go.
+		Registry struct {
+			Key string `json:"key,omitempty"`
+			// Как часто в секундах перечитывать объявления.
+			Refresh int `json:"refresh,omitempty"`
+		} `json:"registry,omitempty"`
 	} `json:"redis"`
 	Irc struct {
-		Server    string   `json:"server,omitempty"`
-		Port      int      `json:"port,omitempty"`
-		Ssl       bool     `json:"ssl,omitempty"`
-		SslVerify bool     `json:"ssl_verify,omitempty"`
-		Nick      string   `json:"nick,omitempty"`
-		User      string   `json:"user,omitempty"`
-		Password  string   `json:"password,omitempty"`
-		Sasl      bool     `json:"sasl,omitempty"`
-		Channels  []string `json:"channels"`
-		RateLimit struct {
+		Server    string `json:"server,omitempty"`
+		Port      int    `json:"port,omitempty"`
+		Ssl       bool   `json:"ssl,omitempty"`
+		SslVerify bool   `json:"ssl_verify,omitempty"`
+		Nick      string `json:"nick,omitempty"`
+		User      string `json:"user,omitempty"`
+		Password  string `json:"password,omitempty"`
+		// Пароль можно взять из переменной окружения или файла, см. config-secrets.go.
+		PasswordEnv  string `json:"password_env,omitempty"`
+		PasswordFile string `json:"password_file,omitempty"`
+		// Пароль сервера (команда PASS), не путать с паролем для NickServ или SASL.
+		ServerPassword     string          `json:"server_password,omitempty"`
+		ServerPasswordEnv  string          `json:"server_password_env,omitempty"`
+		ServerPasswordFile string          `json:"server_password_file,omitempty"`
+		Sasl               bool            `json:"sasl,omitempty"`
+		Channels           []channelConfig `json:"channels"`
+		// Дописывается в конец каждого куска длинного сообщения, кроме последнего, если сообщение пришлось порезать.
+		SplitMarker string `json:"split_marker,omitempty"`
+		RateLimit   struct {
 			Type        string `json:"type,omitempty"`
 			SimpleDelay int    `json:"simple_delay,omitempty"`
 			TokenBucket struct {
@@ -26,17 +88,105 @@ type myConfig struct {
 				Limit          int   `json:"limit,omitempty"`
 				ExpirationTime int64 `json:"expiration_time,omitempty"`
 			} `json:"token_bucket,omitempty"`
-		}
-	}
+			// Максимальное количество сообщений в очереди к одному каналу или нику.
+			QueueDepth int `json:"queue_depth,omitempty"`
+			// Сколько секунд при выключении ждать, пока отправятся сообщения, оставшиеся в очереди.
+			DrainTimeout int `json:"drain_timeout,omitempty"`
+		} `json:"ratelimit"`
+		// Сообщение, с которым бот выходит из IRC.
+		QuitMessage string `json:"quit_message,omitempty"`
+		// Ответы на CTCP-запросы.
+		Ctcp struct {
+			// Ответ на CTCP VERSION.
+			Version string `json:"version,omitempty"`
+			// Ответ на CTCP SOURCE, обычно ссылка на исходники.
+			Source string `json:"source,omitempty"`
+			// Ответ на CTCP USERINFO.
+			Userinfo string `json:"userinfo,omitempty"`
+			// CTCP-запросы, на которые бот не отвечает, например, TIME.
+			Disabled []string `json:"disabled,omitempty"`
+		} `json:"ctcp,omitempty"`
+		// Приватные сообщения (query) боту.
+		Private struct {
+			Enabled bool `json:"enabled,omitempty"`
+			// Маски nick!user@host или $a:account, которым приват разрешён, пустой список разрешает всем.
+			Allow []string `json:"allow,omitempty"`
+			// Маски nick!user@host или $a:account, которым приват запрещён, имеет приоритет над allow.
+			Deny      []string `json:"deny,omitempty"`
+			RateLimit struct {
+				// Не более messages сообщений от одного пользователя за period секунд.
+				Messages int   `json:"messages,omitempty"`
+				Period   int64 `json:"period,omitempty"`
+			} `json:"ratelimit,omitempty"`
+			// Не более daily_quota сообщений от одного пользователя в сутки.
+			DailyQuota int `json:"daily_quota,omitempty"`
+		} `json:"private,omitempty"`
+		// Ники сервисов сети, NOTICE-ы от них не пересылаются в router, а обрабатываются отдельно.
+		Services []string `json:"services,omitempty"`
+		// Права на команду !admin, см. irc-acl.go.
+		Admin struct {
+			// Маски nick!user@host или $a:account владельцев бота, владелец - админ на всех каналах.
+			Owners []string `json:"owners,omitempty"`
+			// Считать ли операторов канала его админами, если не задано - считать.
+			OpsAreAdmins *bool `json:"ops_are_admins,omitempty"`
+		} `json:"admin,omitempty"`
+	} `json:"irc"`
 	Loglevel    string `json:"loglevel,omitempty"`
 	Log         string `json:"log,omitempty"`
 	Csign       string `json:"csign,omitempty"`
 	ForwardsMax int64  `json:"forwards_max,omitempty"`
 	DataDir     string `json:"data_dir,omitempty"`
+	// Команды, которые пересылаются в router, если список пуст, то используется встроенный, см. command-registry.go.
+	Commands []commandSpec `json:"commands,omitempty"`
+}
+
+// Команда бота, которая пересылается в router.
+type commandSpec struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases,omitempty"`
+	// Что может идти после команды: none - ничего, text - произвольный текст, nick - ник участника канала.
+	Args string `json:"args,omitempty"`
+	// Как аргумент выглядит в !help, например, <город>.
+	Usage string `json:"usage,omitempty"`
+	// Отключаемый плагин, к которому относится команда, см. plugin-toggles.go.
+	Toggle string `json:"toggle,omitempty"`
+	// Описание для !help, команды без описания в !help не показываются.
+	Help string `json:"help,omitempty"`
 }
 
-// Входящее сообщение из pubsub-канала redis-ки.
+// Настройки IRC-канала. В конфиге канал можно задать и строкой "#channel key", см. irc-channel-config.go.
+type channelConfig struct {
+	Name string `json:"name"`
+	// Ключ канала (channel MODE +k), если он есть.
+	Key string `json:"key,omitempty"`
+	// Заходить ли на канал при подключении к серверу, по-умолчанию true.
+	Autojoin  bool `json:"autojoin"`
+	RateLimit struct {
+		// Минимальная задержка в миллисекундах между сообщениями в этот канал, действует поверх общего ratelimit-а.
+		SimpleDelay int `json:"simple_delay,omitempty"`
+	} `json:"ratelimit,omitempty"`
+	// Символ-префикс команд на этом канале, если не задан, то берётся общий csign.
+	Csign string `json:"csign,omitempty"`
+	// Имена или синонимы команд, которые на этом канале пересылаются в router, если список пуст, то пересылаются все.
+	Plugins []string `json:"plugins,omitempty"`
+}
+
+// Параметры командной строки.
+type cmdlineFlags struct {
+	// Путь к конфигу, если задан, то конфиг ищется только там.
+	ConfigPath string
+	// Каталог с данными, перекрывает data_dir из конфига.
+	DataDir string
+	// Только проверить конфиг и выйти.
+	CheckConfig bool
+	// Вывести конфиг со всеми default-ами и выйти.
+	DumpConfig bool
+}
+
+// Входящее сообщение из шины, схема описана в msg-schema.go.
 type rMsg struct {
+	// Версия схемы сообщения, у старых отправителей её нет.
+	Version  int    `json:"version,omitempty"`
 	From     string `json:"from,omitempty"`
 	Chatid   string `json:"chatid,omitempty"`
 	Userid   string `json:"userid,omitempty"`
@@ -51,12 +201,18 @@ type rMsg struct {
 		Fwdcnt      int64  `json:"fwd_cnt,omitempty"`
 		GoodMorning int64  `json:"good_morning,omitempty"`
 		Msgformat   int64  `json:"msg_format,omitempty"`
-		Username    string `json:"username,omitempty"`
-	} `json:"Misc"`
+		// Тип сообщения: privmsg (по-умолчанию), action, notice или ctcp_reply.
+		MsgType  string `json:"msg_type,omitempty"`
+		Username string `json:"username,omitempty"`
+		// Роутер может вернуть нам эти поля из нашего же сообщения, мы их не используем.
+		Account    string `json:"account,omitempty"`
+		ServerTime string `json:"server_time,omitempty"`
+	} `json:"misc"`
 }
 
-// Исходящее сообщение в pubsub-канал redis-ки.
+// Исходящее сообщение в шину, схема описана в msg-schema.go.
 type sMsg struct {
+	Version  int    `json:"version"`
 	From     string `json:"from"`
 	Chatid   string `json:"chatid"`
 	Userid   string `json:"userid"`
@@ -72,19 +228,34 @@ type sMsg struct {
 		GoodMorning int64  `json:"good_morning"`
 		Msgformat   int64  `json:"msg_format"`
 		Username    string `json:"username"`
+		Account     string `json:"account"`
+		ServerTime  string `json:"server_time"`
+		MsgType     string `json:"msg_type"`
 	} `json:"misc"`
 }
 
-// TODO: Имплементировать тип сообщения - privmsg или action.
+// Тип исходящего в IRC сообщения.
+type msgKind string
+
+const (
+	// Обычное сообщение, тип по-умолчанию.
+	msgKindPrivmsg msgKind = "privmsg"
+	// Действие, то, что в клиентах пишется как /me.
+	msgKindAction msgKind = "action"
+	// Уведомление, на него не принято отвечать.
+	msgKindNotice msgKind = "notice"
+	// Ответ на CTCP-запрос, Text - это CTCP-команда вместе с параметрами, например, "VERSION aleesa".
+	msgKindCtcpReply msgKind = "ctcp_reply"
+	// Готовая строка протокола, например, JOIN, а не текст сообщения.
+	msgKindRaw msgKind = "raw"
+)
+
+// Исходящее сообщение в IRC.
 type iMsg struct {
 	ChatID string
 	Text   string
-}
-
-// "Ведёрко" для реализации ограничителя скорости отправки исходящих сообщений - Token Bucket.
-type bucket struct {
-	Timestamps []int64
-	IsFull     bool
+	// Тип сообщения, пустой тип означает msgKindPrivmsg.
+	Kind msgKind
 }
 
 /* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
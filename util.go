@@ -1,32 +1,68 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/hjson/hjson-go"
 	log "github.com/sirupsen/logrus"
 )
 
-// Читает и валидирует конфиг, а также выставляет некоторые default-ы, если значений для параметров в конфиге нет.
-func readConfig() {
-	configLoaded := false
+// Имя бинаря по-умолчанию, от имени бинаря зависит, где искать конфиг.
+const defaultBinaryName = "aleesa-irc-go"
+
+// configLocations возвращает пути, по которым ищется конфиг. Имя конфига берётся из имени, под которым запущен бинарь,
+// так что симлинк aleesa-irc-libera на бинарь ищет aleesa-irc-libera.json и несколько инстансов бота могут жить рядом.
+func configLocations() []string {
+	name := strings.TrimSuffix(filepath.Base(os.Args[0]), filepath.Ext(os.Args[0]))
+
+	if name == "" || name == "." {
+		name = defaultBinaryName
+	}
+
+	var locations []string
+
+	if home, err := os.UserHomeDir(); err == nil {
+		locations = append(locations,
+			fmt.Sprintf("%s/.%s.json", home, name),
+			fmt.Sprintf("%s/%s.json", home, name),
+		)
+	} else {
+		log.Warnf("Unable to get user home directory: %s", err)
+	}
+
+	locations = append(locations, fmt.Sprintf("/etc/%s.json", name))
+
 	executablePath, err := os.Executable()
 
 	if err != nil {
 		log.Errorf("Unable to get current executable path: %s", err)
+
+		return locations
 	}
 
-	configJSONPath := fmt.Sprintf("%s/data/config.json", filepath.Dir(executablePath))
+	// Конфиг по-умолчанию в data/config.json ищет только "основной" инстанс, иначе инстансы, запущенные через симлинки,
+	// без собственного конфига молча подхватят чужой.
+	if name == defaultBinaryName {
+		return append(locations, fmt.Sprintf("%s/data/config.json", filepath.Dir(executablePath)))
+	}
 
-	locations := []string{
-		"~/.aleesa-misc-go.json",
-		"~/aleesa-misc-go.json",
-		"/etc/aleesa-misc-go.json",
-		configJSONPath,
+	return append(locations, fmt.Sprintf("%s/data/%s.json", filepath.Dir(executablePath), name))
+}
+
+// readConfig находит и разбирает конфиг. Если путь к конфигу задан в командной строке, то другие места не
+// рассматриваются. Значения из конфига не проверяются, это делает validateConfig().
+func readConfig() (myConfig, string, error) {
+	locations := configLocations()
+
+	if cmdline.ConfigPath != "" {
+		locations = []string{cmdline.ConfigPath}
 	}
 
 	for _, location := range locations {
@@ -83,175 +119,183 @@ func readConfig() {
 			continue
 		}
 
-		// Валидируем значения из конфига
-		if sampleConfig.Redis.Server == "" {
-			sampleConfig.Redis.Server = "localhost"
-
-			log.Infof("Redis server is not defined in config, using localhost")
+		// Каталог с данными из командной строки важнее, чем из конфига
+		if cmdline.DataDir != "" {
+			sampleConfig.DataDir = cmdline.DataDir
 		}
 
-		if sampleConfig.Redis.Port == 0 {
-			sampleConfig.Redis.Port = 6379
-		}
-
-		if sampleConfig.Redis.Channel == "" {
-			log.Errorf("Channel field in config file %s must be set", location)
-			os.Exit(1)
-		}
-
-		if sampleConfig.Redis.MyChannel == "" {
-			log.Errorf("My_channel field in config file %s must be set", location)
-			os.Exit(1)
-		}
-
-		// Значения для IRC-клиента
-		if sampleConfig.Irc.Server == "" {
-			sampleConfig.Irc.Server = "localhost"
-
-			log.Errorf("Irc server is not defined in config, using localhost")
-		}
-
-		if sampleConfig.Irc.Port == 0 {
-			sampleConfig.Irc.Port = 6667
-
-			log.Infof("Irc port is not defined in config, using 6667")
-		}
+		return sampleConfig, location, nil
+	}
 
-		if !sampleConfig.Irc.Ssl {
-			sampleConfig.Irc.SslVerify = false
-		}
+	return myConfig{}, "", fmt.Errorf("no usable config found in %s", strings.Join(locations, ", "))
+}
 
-		if sampleConfig.Irc.Nick == "" {
-			log.Errorf("Irc nick is not defined in config, quitting")
-			os.Exit(1)
-		}
+// applyLogLevel выставляет уровень логгирования из конфига.
+func applyLogLevel() {
+	config := currentConfig()
+
+	// no panic, no trace
+	switch config.Loglevel {
+	case "fatal":
+		log.SetLevel(log.FatalLevel)
+	case "error":
+		log.SetLevel(log.ErrorLevel)
+	case "warn":
+		log.SetLevel(log.WarnLevel)
+	case "info":
+		log.SetLevel(log.InfoLevel)
+	case "debug":
+		log.SetLevel(log.DebugLevel)
+	default:
+		log.SetLevel(log.InfoLevel)
+	}
+}
 
-		if sampleConfig.Irc.User == "" {
-			sampleConfig.Irc.User = sampleConfig.Irc.Nick
-		}
+// openLog направляет лог в файл path, либо в STDOUT, если path пустой. Ранее открытый файл лога закрывается.
+func openLog(path string) error {
+	var file *os.File
 
-		// Если sampleConfig.Irc.Password не задан, то авторизации через Nickserv или SASL не будет
-		// Если sampleConfig.Irc.Sasl не задан, то авторизация происходит через NickServ
+	if path == "" {
+		log.SetOutput(os.Stdout)
+	} else {
+		var err error
 
-		// Нам бот нужен на каких-то IRC-каналах, а не "просто так"
-		if len(sampleConfig.Irc.Channels) < 1 {
-			log.Errorf("No irc channels defined in config, quitting")
-			os.Exit(1)
+		if file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+			return fmt.Errorf("unable to open log file %s: %w", path, err)
 		}
 
-		if (sampleConfig.Irc.RateLimit.Type != "simple_delay") && (sampleConfig.Irc.RateLimit.Type != "token_bucket") {
-			sampleConfig.Irc.RateLimit.Type = "none"
-		}
+		log.SetOutput(file)
+	}
 
-		if sampleConfig.Irc.RateLimit.Type != "simple_delay" {
-			if sampleConfig.Irc.RateLimit.SimpleDelay < 50 {
-				sampleConfig.Irc.RateLimit.SimpleDelay = 50
-			}
-		}
+	if logFile != nil {
+		_ = logFile.Close()
+	}
 
-		if sampleConfig.Irc.RateLimit.Type == "token_bucket" {
-			if sampleConfig.Irc.RateLimit.TokenBucket.Size < 3 {
-				sampleConfig.Irc.RateLimit.TokenBucket.Size = 5
-			}
+	logFile = file
 
-			if sampleConfig.Irc.RateLimit.TokenBucket.Limit == 0 {
-				sampleConfig.Irc.RateLimit.TokenBucket.Limit = 1
-			}
+	return nil
+}
 
-			if sampleConfig.Irc.RateLimit.TokenBucket.Size < sampleConfig.Irc.RateLimit.TokenBucket.Limit {
-				sampleConfig.Irc.RateLimit.TokenBucket.Size = 5
-				sampleConfig.Irc.RateLimit.TokenBucket.Limit = 1
-			}
+// lockDataDir берёт эксклюзивную блокировку на каталог с данными, чтобы два инстанса бота по ошибке не работали с одной
+// и той же базой настроек. Блокировка держится до завершения процесса.
+func lockDataDir() error {
+	config := currentConfig()
 
-			if sampleConfig.Irc.RateLimit.TokenBucket.ExpirationTime < 2 {
-				sampleConfig.Irc.RateLimit.TokenBucket.ExpirationTime = 2
-			}
-		}
+	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+		return fmt.Errorf("unable to create data_dir %s: %w", config.DataDir, err)
+	}
 
-		if sampleConfig.Loglevel == "" {
-			sampleConfig.Loglevel = "info"
-		}
+	lockPath := filepath.Join(config.DataDir, defaultBinaryName+".lock")
+	lockFile, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
 
-		// sampleConfig.Log = "" if not set
+	if err != nil {
+		return fmt.Errorf("unable to open lock file %s: %w", lockPath, err)
+	}
 
-		if sampleConfig.Csign == "" {
-			log.Errorf("Csign field in config file %s must be set", location)
-			os.Exit(1)
-		}
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		pid, _ := os.ReadFile(lockPath)
+		_ = lockFile.Close()
 
-		if sampleConfig.ForwardsMax == 0 {
-			sampleConfig.ForwardsMax = forwardMax
-		}
+		return fmt.Errorf("data_dir %s is already used by another instance (pid %s): %w",
+			config.DataDir, strings.TrimSpace(string(pid)), err)
+	}
 
-		if sampleConfig.DataDir == "" {
-			log.Errorf("Data_dir field in config file %s must be set", location)
-			os.Exit(1)
-		}
+	// Запишем свой pid, чтобы было видно, кто держит блокировку
+	_ = lockFile.Truncate(0)
+	_, _ = fmt.Fprintf(lockFile, "%d\n", os.Getpid())
 
-		config = sampleConfig
-		configLoaded = true
+	dataDirLock = lockFile
 
-		log.Infof("Using %s as config file", location)
+	return nil
+}
 
-		break
-	}
+// Сообщение, с которым бот выходит из IRC, если в конфиге не задано иное.
+const defaultQuitMessage = "Bye!"
 
-	if !configLoaded {
-		log.Error("Config was not loaded! Refusing to start.")
-		os.Exit(1)
-	}
+// shuttingDown возвращает true, если мы получили сигнал на выключение.
+func shuttingDown() bool {
+	return ctx.Err() != nil
 }
 
-// Хэндлер сигналов закрывает все бд, все сетевые соединения и сваливает из приложения.
+// Хэндлер сигналов. По SIGHUP перечитывает конфиг, по первому сигналу на выключение запускает плавное выключение, см.
+// gracefulShutdown(), а по второму - выходит из приложения немедленно.
 func sigHandler() {
-	var err error
-
 	for {
 		var s = <-sigChan
 		switch s {
-		case syscall.SIGINT:
-			log.Infoln("Got SIGINT, quitting")
-		case syscall.SIGTERM:
-			log.Infoln("Got SIGTERM, quitting")
-		case syscall.SIGQUIT:
-			log.Infoln("Got SIGQUIT, quitting")
-
-		// Заходим на новую итерацию, если у нас "неинтересный" сигнал
-		default:
-			continue
-		}
+		case syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT:
+			if shuttingDown() {
+				log.Warnf("Got %s while shutting down, quitting immediately", s)
+				os.Exit(1)
+			}
 
-		// Чтобы не срать в логи ошибками от редиски, проставим shutdown state приложения в true
-		shutdown = true
+			log.Infof("Got %s, quitting", s)
 
-		// Отпишемся от всех каналов и закроем коннект к редиске
-		if err = subscriber.Unsubscribe(ctx); err != nil {
-			log.Errorf("Unable to unsubscribe from redis channels cleanly: %s", err)
-		} else {
-			log.Debug("Unsubscribe from all redis channels")
+			// Основной контекст отменяется, после этого main() запускает gracefulShutdown()
+			stopApp()
+		case syscall.SIGHUP:
+			log.Infoln("Got SIGHUP, reloading config")
+			reloadConfig()
 		}
+	}
+}
 
-		if err = subscriber.Close(); err != nil {
-			log.Errorf("Unable to close redis connection cleanly: %s", err)
-		} else {
-			log.Debug("Close redis connection")
-		}
+// gracefulShutdown отправляет всё, что накопилось в очереди сообщений в IRC, выходит из IRC и закрывает все бд и
+// сетевые соединения.
+func gracefulShutdown() {
+	config := currentConfig()
+
+	// Основной контекст уже отменён, поэтому для закрытия соединений нужен свой
+	cleanupCtx := context.Background()
+
+	// От канала редиски шина отписывается сама, как только отменён основной контекст, так что новые сообщения к нам
+	// больше не прилетают
+
+	// Дадим отправиться тому, что уже стоит в очереди
+	drainTimeout := time.Duration(config.Irc.RateLimit.DrainTimeout) * time.Second
+	drainCtx, cancel := context.WithTimeout(cleanupCtx, drainTimeout)
+
+	if pending := sender.Len(); pending > 0 {
+		log.Infof("Waiting up to %s for %d queued messages to be sent", drainTimeout, pending)
+	}
+
+	if dropped := sender.Drain(drainCtx); dropped > 0 {
+		log.Warnf("Drain timeout expired, dropping %d queued messages", dropped)
+	}
 
+	cancel()
+	stopSender()
+
+	if ircClient != nil && ircClient.Connected() {
 		log.Debug("Close irc connection")
+		ircClient.QuitMessage = config.Irc.QuitMessage
 		ircClient.Quit()
-		log.Debug("Close userModeDB")
-		userMode.Close()
+	}
 
-		if len(settingsDB) > 0 {
-			log.Debug("Closing runtime irc channel settings db")
+	// Подождём, пока сервер закроет соединение в ответ на QUIT
+	select {
+	case <-ircDone:
+	case <-time.After(drainTimeout):
+		log.Warn("Irc connection did not close in time")
+	}
+
+	if len(settingsDB) > 0 {
+		log.Debug("Closing runtime irc channel settings db")
 
-			for _, db := range settingsDB {
-				_ = db.Close()
+		for name, db := range settingsDB {
+			if err := db.Close(); err != nil {
+				log.Errorf("Unable to close settings db %s cleanly: %s", name, err)
 			}
 		}
+	}
 
-		os.Exit(0)
+	if err := bus.Close(); err != nil {
+		log.Errorf("Unable to close message bus cleanly: %s", err)
+	} else {
+		log.Debug("Close message bus")
 	}
+
+	log.Info("Bye")
 }
 
 /* vim: set ft=go noet ai ts=4 sw=4 sts=4: */